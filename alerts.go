@@ -0,0 +1,290 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Alerts come from the GBFS system_alerts feed. An alert concerns the
+// stations it lists, the stations of the regions it lists, or the whole
+// system when it lists neither. It is active during any of its time
+// ranges, or always when it has none.
+
+const alertsInterval = 5 * time.Minute
+
+type AlertTime struct {
+	Start time.Time  `json:"start"`
+	End   *time.Time `json:"end,omitempty"`
+}
+
+type Alert struct {
+	AlertId string
+	// system_closure, station_closure, station_move or other
+	Type        string
+	Summary     string
+	Description string
+	Url         string `json:",omitempty"`
+	Times       []AlertTime
+	StationIds  []int64
+	RegionIds   []string
+	LastUpdated *time.Time `json:",omitempty"`
+}
+
+func (a Alert) SystemWide() bool {
+	return len(a.StationIds) == 0 && len(a.RegionIds) == 0
+}
+
+// Concerns tells whether the alert applies to a station of a region.
+func (a Alert) Concerns(stationId int, regionId string) bool {
+	return a.SystemWide() || slices.Contains(a.StationIds, int64(stationId)) || (regionId != "" && slices.Contains(a.RegionIds, regionId))
+}
+
+// gbfsAlert is an alert as listed by system_alerts.
+type gbfsAlert struct {
+	AlertId gbfsId `json:"alert_id"`
+	Type    string `json:"type"`
+	Times   []struct {
+		Start json.RawMessage `json:"start"`
+		End   json.RawMessage `json:"end"`
+	} `json:"times"`
+	StationIds  []gbfsId        `json:"station_ids"`
+	RegionIds   []gbfsId        `json:"region_ids"`
+	Url         json.RawMessage `json:"url"`
+	Summary     json.RawMessage `json:"summary"`
+	Description json.RawMessage `json:"description"`
+	LastUpdated json.RawMessage `json:"last_updated"`
+}
+
+// parse reads the alert, leaving out station ids which are not numbers.
+func (a gbfsAlert) parse() (Alert, error) {
+	alert := Alert{
+		AlertId:     string(a.AlertId),
+		Type:        a.Type,
+		Summary:     localizedText(a.Summary),
+		Description: localizedText(a.Description),
+		Url:         localizedText(a.Url),
+		Times:       []AlertTime{},
+		StationIds:  []int64{},
+		RegionIds:   []string{},
+	}
+	if alert.AlertId == "" {
+		return alert, errors.New("alert without alert_id")
+	}
+
+	if len(a.LastUpdated) > 0 {
+		t, err := gbfsTime(a.LastUpdated)
+		if err != nil {
+			return alert, err
+		}
+		alert.LastUpdated = &t
+	}
+
+	for _, times := range a.Times {
+		start, err := gbfsTime(times.Start)
+		if err != nil {
+			return alert, err
+		}
+		alertTime := AlertTime{Start: start}
+		if len(times.End) > 0 {
+			end, err := gbfsTime(times.End)
+			if err != nil {
+				return alert, err
+			}
+			alertTime.End = &end
+		}
+		alert.Times = append(alert.Times, alertTime)
+	}
+
+	for _, stationId := range a.StationIds {
+		id, err := strconv.ParseInt(string(stationId), 10, 64)
+		if err != nil {
+			log.Printf("alert %s: invalid station id %s", alert.AlertId, stationId)
+			continue
+		}
+		if !slices.Contains(alert.StationIds, id) {
+			alert.StationIds = append(alert.StationIds, id)
+		}
+	}
+	for _, regionId := range a.RegionIds {
+		if !slices.Contains(alert.RegionIds, string(regionId)) {
+			alert.RegionIds = append(alert.RegionIds, string(regionId))
+		}
+	}
+
+	return alert, nil
+}
+
+// parseAlerts reads the alerts of the feed. Invalid alerts, and repeated
+// alert ids after the first, are logged and left out rather than failing
+// the whole refresh.
+func parseAlerts(entries []gbfsAlert) []Alert {
+	alerts := []Alert{}
+	seen := map[string]bool{}
+	for _, entry := range entries {
+		alert, err := entry.parse()
+		if err != nil {
+			log.Printf("alert %s: %v", entry.AlertId, err)
+			continue
+		}
+		if seen[alert.AlertId] {
+			log.Printf("alert %s: listed more than once", alert.AlertId)
+			continue
+		}
+		seen[alert.AlertId] = true
+		alerts = append(alerts, alert)
+	}
+	return alerts
+}
+
+// refreshAlerts replaces the stored alerts by those of the feed.
+func refreshAlerts() error {
+	var feed struct {
+		Data struct {
+			Alerts []gbfsAlert
+		}
+	}
+	err := fetchGbfsFeed("system_alerts", &feed)
+	if err != nil {
+		return err
+	}
+
+	alerts := parseAlerts(feed.Data.Alerts)
+
+	tx, err := db.BeginTx(context.Background(), nil)
+	if err != nil {
+		return err
+	}
+
+	// alerts are replaced as a whole, their times, stations and regions
+	// going along
+	_, err = tx.Exec("DELETE FROM alerts")
+	if err != nil {
+		return errors.Join(err, tx.Rollback())
+	}
+
+	for _, alert := range alerts {
+		_, err = tx.Exec("INSERT INTO alerts (alert_id, type, summary, description, url, last_updated, updated_at) VALUES ($1, $2, $3, $4, $5, $6, NOW())",
+			alert.AlertId, alert.Type, alert.Summary, alert.Description, alert.Url, alert.LastUpdated)
+		if err != nil {
+			return errors.Join(err, tx.Rollback())
+		}
+
+		for _, times := range alert.Times {
+			_, err = tx.Exec("INSERT INTO alert_times (alert_id, starts_at, ends_at) VALUES ($1, $2, $3)", alert.AlertId, times.Start, times.End)
+			if err != nil {
+				return errors.Join(err, tx.Rollback())
+			}
+		}
+
+		_, err = tx.Exec("INSERT INTO alert_stations (alert_id, station_id) SELECT $1, unnest($2::bigint[])", alert.AlertId, pq.Array(alert.StationIds))
+		if err != nil {
+			return errors.Join(err, tx.Rollback())
+		}
+		_, err = tx.Exec("INSERT INTO alert_regions (alert_id, region_id) SELECT $1, unnest($2::text[])", alert.AlertId, pq.Array(alert.RegionIds))
+		if err != nil {
+			return errors.Join(err, tx.Rollback())
+		}
+	}
+
+	return tx.Commit()
+}
+
+func refreshAlertsPeriodically() {
+	ticker := time.NewTicker(alertsInterval)
+	defer ticker.Stop()
+	for {
+		err := refreshAlerts()
+		if err != nil {
+			log.Print(err)
+		}
+		<-ticker.C
+	}
+}
+
+// activeAlerts returns the alerts active now.
+func activeAlerts() ([]Alert, error) {
+	rows, err := db.Query(`SELECT a.alert_id, a.type, a.summary, a.description, a.url, a.last_updated,
+		COALESCE((SELECT json_agg(json_build_object('start', t.starts_at, 'end', t.ends_at) ORDER BY t.starts_at) FROM alert_times t WHERE t.alert_id = a.alert_id), '[]'),
+		ARRAY(SELECT s.station_id FROM alert_stations s WHERE s.alert_id = a.alert_id ORDER BY s.station_id),
+		ARRAY(SELECT r.region_id FROM alert_regions r WHERE r.alert_id = a.alert_id ORDER BY r.region_id)
+		FROM alerts a
+		WHERE NOT EXISTS (SELECT 1 FROM alert_times t WHERE t.alert_id = a.alert_id)
+		OR EXISTS (SELECT 1 FROM alert_times t WHERE t.alert_id = a.alert_id AND t.starts_at <= NOW() AND (t.ends_at IS NULL OR t.ends_at > NOW()))
+		ORDER BY a.alert_id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	alerts := []Alert{}
+	for rows.Next() {
+		var alert Alert
+		var times []byte
+		err := rows.Scan(&alert.AlertId, &alert.Type, &alert.Summary, &alert.Description, &alert.Url, &alert.LastUpdated, &times, pq.Array(&alert.StationIds), pq.Array(&alert.RegionIds))
+		if err != nil {
+			return nil, err
+		}
+		err = json.Unmarshal(times, &alert.Times)
+		if err != nil {
+			return nil, err
+		}
+
+		alerts = append(alerts, alert)
+	}
+
+	return alerts, rows.Err()
+}
+
+// withAlerts sets the active alerts of each station. Alerts are not kept
+// in history, so past stations get none.
+func withAlerts(stations []Station, at time.Time) error {
+	if len(stations) == 0 || !at.IsZero() {
+		return nil
+	}
+
+	alerts, err := activeAlerts()
+	if err != nil || len(alerts) == 0 {
+		return err
+	}
+
+	ids := make([]int, len(stations))
+	for i, station := range stations {
+		ids[i] = station.StationId
+	}
+	rows, err := db.Query("SELECT station_id, region_id FROM stations WHERE station_id = ANY($1)", pq.Array(ids))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	regions := map[int]string{}
+	for rows.Next() {
+		var stationId int
+		var regionId string
+		err := rows.Scan(&stationId, &regionId)
+		if err != nil {
+			return err
+		}
+		regions[stationId] = regionId
+	}
+	if rows.Err() != nil {
+		return rows.Err()
+	}
+
+	for i, station := range stations {
+		for _, alert := range alerts {
+			if alert.Concerns(station.StationId, regions[station.StationId]) {
+				stations[i].Alerts = append(stations[i].Alerts, alert)
+			}
+		}
+	}
+
+	return nil
+}
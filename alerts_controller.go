@@ -0,0 +1,49 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+type AlertsController struct{}
+
+// List returns the active alerts, or with station_id those concerning a
+// station.
+func (c *AlertsController) List(w http.ResponseWriter, r *http.Request) {
+	params := r.URL.Query()
+	var alerts []Alert
+	var err error
+	if !params.Has("station_id") {
+		alerts, err = activeAlerts()
+		if err != nil {
+			defer handleHttpError(w, err)
+			return
+		}
+	} else {
+		stationId, err := strconv.Atoi(params.Get("station_id"))
+		if err != nil {
+			defer handleHttpBadRequest(w, err)
+			return
+		}
+
+		stations := []Station{{StationId: stationId}}
+		err = withAlerts(stations, time.Time{})
+		if err != nil {
+			defer handleHttpError(w, err)
+			return
+		}
+		alerts = stations[0].Alerts
+		if alerts == nil {
+			alerts = []Alert{}
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(alerts)
+	if err != nil {
+		defer handleHttpError(w, err)
+		return
+	}
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"encoding/json"
+	"slices"
+	"testing"
+)
+
+func TestParseAlerts(t *testing.T) {
+	var feed struct {
+		Data struct {
+			Alerts []gbfsAlert
+		}
+	}
+	err := json.Unmarshal([]byte(`{"data": {"alerts": [
+		{"alert_id": "1", "type": "station_closure", "station_ids": ["16107", "16107", "nope"], "times": [{"start": 1760000000, "end": 1760003600}], "summary": "Travaux"},
+		{"alert_id": "2", "type": "other", "times": [{"start": "not a time"}], "summary": "Invalid"},
+		{"alert_id": 3, "type": "system_closure", "summary": [{"text": "Fermeture", "language": "fr"}]},
+		{"alert_id": "1", "type": "other", "summary": "Repeated"},
+		{"type": "other", "summary": "Without id"}
+	]}}`), &feed)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	alerts := parseAlerts(feed.Data.Alerts)
+	ids := []string{}
+	for _, alert := range alerts {
+		ids = append(ids, alert.AlertId)
+	}
+	if !slices.Equal(ids, []string{"1", "3"}) {
+		t.Fatalf("alert ids = %v, want [1 3]", ids)
+	}
+
+	if alerts[0].Summary != "Travaux" || !slices.Equal(alerts[0].StationIds, []int64{16107}) {
+		t.Errorf("alert 1 = %+v, want the first listing with station 16107 once", alerts[0])
+	}
+	if len(alerts[0].Times) != 1 || alerts[0].Times[0].End == nil || alerts[0].Times[0].End.Sub(alerts[0].Times[0].Start).Hours() != 1 {
+		t.Errorf("alert 1 times = %+v, want one hour", alerts[0].Times)
+	}
+	if !alerts[1].SystemWide() || alerts[1].Summary != "Fermeture" {
+		t.Errorf("alert 3 = %+v, want a system wide closure", alerts[1])
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+type AnalyticsController struct{}
+
+// parseTimeRange reads the from and to RFC 3339 parameters, defaulting to
+// the last 24 hours.
+func parseTimeRange(params url.Values) (time.Time, time.Time, error) {
+	to := time.Now()
+	from := to.Add(-24 * time.Hour)
+
+	var err error
+	if params.Has("to") {
+		to, err = time.Parse(time.RFC3339, params.Get("to"))
+		if err != nil {
+			return from, to, err
+		}
+		from = to.Add(-24 * time.Hour)
+	}
+	if params.Has("from") {
+		from, err = time.Parse(time.RFC3339, params.Get("from"))
+		if err != nil {
+			return from, to, err
+		}
+	}
+
+	if !from.Before(to) {
+		return from, to, errors.New("from must be before to")
+	}
+	if to.Sub(from) > maxFlowRange {
+		return from, to, errors.New("the time range cannot exceed 7 days")
+	}
+	return from, to, nil
+}
+
+func writeCsv(w http.ResponseWriter, filename string, records [][]string) {
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", `attachment; filename="`+filename+`"`)
+	err := csv.NewWriter(w).WriteAll(records)
+	if err != nil {
+		defer handleHttpError(w, err)
+		return
+	}
+}
+
+// ListStationFlows returns inferred departures and arrivals per station and
+// interval, as JSON or with format=csv as CSV.
+func (c *AnalyticsController) ListStationFlows(w http.ResponseWriter, r *http.Request) {
+	params := r.URL.Query()
+	from, to, err := parseTimeRange(params)
+	if err != nil {
+		defer handleHttpBadRequest(w, err)
+		return
+	}
+
+	stationId, err := optionalInt(params, "station_id", 0)
+	if err != nil {
+		defer handleHttpBadRequest(w, err)
+		return
+	}
+
+	flows, err := stationFlows(from, to, stationId)
+	if err != nil {
+		defer handleHttpError(w, err)
+		return
+	}
+
+	if params.Get("format") == "csv" {
+		records := [][]string{{"station_id", "interval_start", "departures", "arrivals"}}
+		for _, flow := range flows {
+			records = append(records, []string{strconv.Itoa(flow.StationId), flow.IntervalStart.Format(time.RFC3339), strconv.Itoa(flow.Departures), strconv.Itoa(flow.Arrivals)})
+		}
+		writeCsv(w, "station-flows.csv", records)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(flows)
+	if err != nil {
+		defer handleHttpError(w, err)
+		return
+	}
+}
+
+// ListFlows returns the estimated origin-destination trips between
+// neighborhoods, as JSON or with format=csv as CSV. Neighborhoods are the
+// administrative areas when loaded, or grid cells with group=grid.
+func (c *AnalyticsController) ListFlows(w http.ResponseWriter, r *http.Request) {
+	params := r.URL.Query()
+	from, to, err := parseTimeRange(params)
+	if err != nil {
+		defer handleHttpBadRequest(w, err)
+		return
+	}
+
+	grouping := defaultFlowGrouping()
+	switch params.Get("group") {
+	case "":
+	case "grid":
+		grouping = gridNeighborhood
+	case "areas":
+		if len(areas) == 0 {
+			areasUnavailable(w)
+			return
+		}
+		grouping = areaNeighborhood
+	default:
+		defer handleHttpBadRequest(w, errors.New("group must be areas or grid"))
+		return
+	}
+
+	flows, err := originDestinationFlows(from, to, grouping)
+	if err != nil {
+		defer handleHttpError(w, err)
+		return
+	}
+
+	if params.Get("format") == "csv" {
+		records := [][]string{{"origin", "destination", "trips"}}
+		for _, flow := range flows {
+			records = append(records, []string{flow.Origin, flow.Destination, strconv.FormatFloat(flow.Trips, 'f', 1, 64)})
+		}
+		writeCsv(w, "flows.csv", records)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(flows)
+	if err != nil {
+		defer handleHttpError(w, err)
+		return
+	}
+}
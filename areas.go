@@ -0,0 +1,324 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Administrative areas, such as arrondissements or communes, come from the
+// GeoJSON file named by VELIB_AREAS_FILE. Stations are assigned to the
+// area containing them at each refresh, so that history can be summed up
+// per area too.
+
+const (
+	defaultAreaInterval = 15 * time.Minute
+	minAreaInterval     = 5 * time.Minute
+)
+
+// areaIdProperties and areaNameProperties are the feature properties
+// looked for, in order, covering Paris open data and IGN files.
+var (
+	areaIdProperties   = []string{"c_arinsee", "code_insee", "insee", "code", "id"}
+	areaNameProperties = []string{"l_ar", "nom", "nom_com", "name", "libelle"}
+)
+
+type Area struct {
+	Id   string
+	Name string
+	// polygons of rings of [longitude, latitude] points, the first ring of
+	// each polygon being its outline and the others its holes
+	polygons [][][][2]float64
+	bbox     BBox
+}
+
+type AreaTotals struct {
+	AreaId        string
+	Name          string
+	At            time.Time
+	Stations      int
+	BikeCount     int `json:"numBikesAvailable"`
+	EBikeCount    int `json:"numEBikesAvailable"`
+	DockCount     int `json:"numDocksAvailable"`
+	EmptyStations int
+	FullStations  int
+}
+
+// areas is loaded once at startup, and empty without VELIB_AREAS_FILE.
+var areas []Area
+
+func loadAreas() error {
+	path := os.Getenv("VELIB_AREAS_FILE")
+	if path == "" {
+		return nil
+	}
+
+	loaded, err := readAreas(path)
+	if err != nil {
+		return err
+	}
+	areas = loaded
+	return nil
+}
+
+func featureProperty(properties map[string]any, names []string) string {
+	for _, name := range names {
+		switch value := properties[name].(type) {
+		case string:
+			if value != "" {
+				return value
+			}
+		case float64:
+			return strconv.FormatFloat(value, 'f', -1, 64)
+		}
+	}
+	return ""
+}
+
+func readAreas(path string) ([]Area, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var collection struct {
+		Features []struct {
+			Properties map[string]any
+			Geometry   struct {
+				Type        string
+				Coordinates json.RawMessage
+			}
+		}
+	}
+	err = json.NewDecoder(f).Decode(&collection)
+	if err != nil {
+		return nil, err
+	}
+
+	loaded := []Area{}
+	for i, feature := range collection.Features {
+		area := Area{Id: featureProperty(feature.Properties, areaIdProperties), Name: featureProperty(feature.Properties, areaNameProperties)}
+		if area.Id == "" {
+			area.Id = strconv.Itoa(i + 1)
+		}
+		if area.Name == "" {
+			area.Name = area.Id
+		}
+
+		switch feature.Geometry.Type {
+		case "Polygon":
+			var polygon [][][2]float64
+			err = json.Unmarshal(feature.Geometry.Coordinates, &polygon)
+			area.polygons = [][][][2]float64{polygon}
+		case "MultiPolygon":
+			err = json.Unmarshal(feature.Geometry.Coordinates, &area.polygons)
+		default:
+			// points or lines do not contain stations
+			continue
+		}
+		if err != nil {
+			return nil, errors.Join(errors.New(fmt.Sprintf("%s: area %s", path, area.Id)), err)
+		}
+
+		area.bbox = BBox{West: math.Inf(1), South: math.Inf(1), East: math.Inf(-1), North: math.Inf(-1)}
+		for _, polygon := range area.polygons {
+			if len(polygon) == 0 {
+				continue
+			}
+			for _, point := range polygon[0] {
+				area.bbox.West = math.Min(area.bbox.West, point[0])
+				area.bbox.East = math.Max(area.bbox.East, point[0])
+				area.bbox.South = math.Min(area.bbox.South, point[1])
+				area.bbox.North = math.Max(area.bbox.North, point[1])
+			}
+		}
+		loaded = append(loaded, area)
+	}
+
+	return loaded, nil
+}
+
+// insideRing tells whether a point is inside a ring, by counting the edges
+// a ray going east from it crosses.
+func insideRing(ring [][2]float64, lat, lon float64) bool {
+	inside := false
+	for i, j := 0, len(ring)-1; i < len(ring); j, i = i, i+1 {
+		a, b := ring[i], ring[j]
+		if (a[1] > lat) != (b[1] > lat) && lon < (b[0]-a[0])*(lat-a[1])/(b[1]-a[1])+a[0] {
+			inside = !inside
+		}
+	}
+	return inside
+}
+
+func (a Area) Contains(lat, lon float64) bool {
+	if !a.bbox.Contains(lat, lon) {
+		return false
+	}
+	for _, polygon := range a.polygons {
+		if len(polygon) == 0 || !insideRing(polygon[0], lat, lon) {
+			continue
+		}
+		if !slices.ContainsFunc(polygon[1:], func(hole [][2]float64) bool { return insideRing(hole, lat, lon) }) {
+			return true
+		}
+	}
+	return false
+}
+
+// areaOf returns the area containing a point, if any.
+func areaOf(lat, lon float64) (Area, bool) {
+	for _, area := range areas {
+		if area.Contains(lat, lon) {
+			return area, true
+		}
+	}
+	return Area{}, false
+}
+
+// recordStationAreas assigns the stations of a refresh to their area.
+// Stations no longer listed keep theirs, for their history.
+func recordStationAreas(tx *sql.Tx, stations []Station) error {
+	if len(areas) == 0 {
+		return nil
+	}
+
+	var stationIds, outside []int
+	var areaIds []string
+	for _, station := range stations {
+		area, ok := areaOf(station.Lat, station.Lon)
+		if ok {
+			stationIds = append(stationIds, station.StationId)
+			areaIds = append(areaIds, area.Id)
+		} else {
+			outside = append(outside, station.StationId)
+		}
+	}
+
+	_, err := tx.Exec("DELETE FROM station_areas WHERE station_id = ANY($1)", pq.Array(outside))
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("INSERT INTO station_areas (station_id, area_id) SELECT * FROM unnest($1::bigint[], $2::text[]) ON CONFLICT (station_id) DO UPDATE SET area_id = EXCLUDED.area_id", pq.Array(stationIds), pq.Array(areaIds))
+	return err
+}
+
+func stationAreaIds() (map[int]string, error) {
+	rows, err := db.Query("SELECT station_id, area_id FROM station_areas")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	areaIds := map[int]string{}
+	for rows.Next() {
+		var stationId int
+		var areaId string
+		err := rows.Scan(&stationId, &areaId)
+		if err != nil {
+			return nil, err
+		}
+		areaIds[stationId] = areaId
+	}
+
+	return areaIds, rows.Err()
+}
+
+func areaName(areaId string) string {
+	for _, area := range areas {
+		if area.Id == areaId {
+			return area.Name
+		}
+	}
+	return areaId
+}
+
+// areaTotals sums up the stations of each area as of at, or live when at
+// is zero. Areas without stations are listed with zero totals.
+func areaTotals(at time.Time) ([]AreaTotals, error) {
+	stations, err := stationsInBBoxAt(BBox{West: -180, South: -90, East: 180, North: 90}, at)
+	if err != nil {
+		return nil, err
+	}
+	areaIds, err := stationAreaIds()
+	if err != nil {
+		return nil, err
+	}
+
+	if at.IsZero() {
+		at = time.Now()
+	}
+	totals := make([]AreaTotals, len(areas))
+	index := map[string]int{}
+	for i, area := range areas {
+		totals[i] = AreaTotals{AreaId: area.Id, Name: area.Name, At: at}
+		index[area.Id] = i
+	}
+
+	for _, station := range stations {
+		i, ok := index[areaIds[station.StationId]]
+		if !ok {
+			continue
+		}
+		totals[i].add(station.BikeCount, station.EBikeCount, station.DockCount)
+	}
+
+	return totals, nil
+}
+
+func (t *AreaTotals) add(bikes, ebikes, docks int) {
+	t.Stations++
+	t.BikeCount += bikes
+	t.EBikeCount += ebikes
+	t.DockCount += docks
+	if bikes == 0 {
+		t.EmptyStations++
+	}
+	if docks == 0 {
+		t.FullStations++
+	}
+}
+
+// areaHistory returns the totals of each area over time, averaged over the
+// refreshes of each interval, optionally for a single area.
+func areaHistory(from, to time.Time, interval time.Duration, areaId string) ([]AreaTotals, error) {
+	rows, err := db.Query(`SELECT area_id, to_timestamp(floor(extract(epoch FROM recorded_at) / $3) * $3) AS interval_start,
+		round(avg(stations)), round(avg(bikes)), round(avg(ebikes)), round(avg(docks)), round(avg(empty)), round(avg(full))
+		FROM (
+			SELECT a.area_id, h.recorded_at, count(*) AS stations, sum(h.bike_count) AS bikes, sum(h.ebike_count) AS ebikes, sum(h.dock_count) AS docks,
+			count(*) FILTER (WHERE h.bike_count = 0) AS empty, count(*) FILTER (WHERE h.dock_count = 0) AS full
+			FROM station_history h JOIN station_areas a ON a.station_id = h.station_id
+			WHERE h.recorded_at >= $1 AND h.recorded_at < $2 AND ($4 = '' OR a.area_id = $4)
+			GROUP BY a.area_id, h.recorded_at
+		) refreshes
+		GROUP BY area_id, interval_start
+		ORDER BY interval_start, area_id`,
+		from, to, interval.Seconds(), areaId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	history := []AreaTotals{}
+	for rows.Next() {
+		var totals AreaTotals
+		err := rows.Scan(&totals.AreaId, &totals.At, &totals.Stations, &totals.BikeCount, &totals.EBikeCount, &totals.DockCount, &totals.EmptyStations, &totals.FullStations)
+		if err != nil {
+			return nil, err
+		}
+		totals.Name = areaName(totals.AreaId)
+
+		history = append(history, totals)
+	}
+
+	return history, rows.Err()
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+type AreasController struct{}
+
+func areasUnavailable(w http.ResponseWriter) {
+	http.Error(w, "administrative areas are not available", http.StatusServiceUnavailable)
+}
+
+func areaTotalsRecords(totals []AreaTotals) [][]string {
+	records := [][]string{{"area_id", "name", "at", "stations", "bikes", "ebikes", "docks", "empty_stations", "full_stations"}}
+	for _, t := range totals {
+		records = append(records, []string{t.AreaId, t.Name, t.At.Format(time.RFC3339), strconv.Itoa(t.Stations), strconv.Itoa(t.BikeCount), strconv.Itoa(t.EBikeCount), strconv.Itoa(t.DockCount), strconv.Itoa(t.EmptyStations), strconv.Itoa(t.FullStations)})
+	}
+	return records
+}
+
+// List returns the totals of bikes, docks and empty or full stations per
+// area, live or as of at, as JSON or with format=csv as CSV.
+func (c *AreasController) List(w http.ResponseWriter, r *http.Request) {
+	params := r.URL.Query()
+	if len(areas) == 0 {
+		areasUnavailable(w)
+		return
+	}
+
+	at, err := parseAt(params)
+	if err != nil {
+		defer handleHttpBadRequest(w, err)
+		return
+	}
+
+	totals, err := areaTotals(at)
+	if err != nil {
+		defer handleHttpError(w, err)
+		return
+	}
+
+	if params.Get("format") == "csv" {
+		writeCsv(w, "areas.csv", areaTotalsRecords(totals))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(totals)
+	if err != nil {
+		defer handleHttpError(w, err)
+		return
+	}
+}
+
+// ListHistory returns the totals per area averaged over intervals of
+// interval minutes, optionally for the area_id area only.
+func (c *AreasController) ListHistory(w http.ResponseWriter, r *http.Request) {
+	params := r.URL.Query()
+	if len(areas) == 0 {
+		areasUnavailable(w)
+		return
+	}
+
+	from, to, err := parseTimeRange(params)
+	if err != nil {
+		defer handleHttpBadRequest(w, err)
+		return
+	}
+
+	minutes, err := optionalInt(params, "interval", int(defaultAreaInterval.Minutes()))
+	if err != nil {
+		defer handleHttpBadRequest(w, err)
+		return
+	}
+	interval := time.Duration(minutes) * time.Minute
+	if interval < minAreaInterval {
+		defer handleHttpBadRequest(w, errors.New(fmt.Sprintf("interval must be at least %d minutes", int(minAreaInterval.Minutes()))))
+		return
+	}
+
+	history, err := areaHistory(from, to, interval, params.Get("area_id"))
+	if err != nil {
+		defer handleHttpError(w, err)
+		return
+	}
+
+	if params.Get("format") == "csv" {
+		writeCsv(w, "areas-history.csv", areaTotalsRecords(history))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(history)
+	if err != nil {
+		defer handleHttpError(w, err)
+		return
+	}
+}
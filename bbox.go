@@ -0,0 +1,65 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+type BBox struct {
+	West  float64
+	South float64
+	East  float64
+	North float64
+}
+
+// ParseBBox reads a "west,south,east,north" bounding box in degrees.
+func ParseBBox(s string) (BBox, error) {
+	parts := strings.Split(s, ",")
+	if len(parts) != 4 {
+		return BBox{}, errors.New(fmt.Sprintf("invalid bbox: %s", s))
+	}
+
+	var coords [4]float64
+	for i, part := range parts {
+		v, err := strconv.ParseFloat(strings.TrimSpace(part), 64)
+		if err != nil {
+			return BBox{}, err
+		}
+		coords[i] = v
+	}
+
+	b := BBox{West: coords[0], South: coords[1], East: coords[2], North: coords[3]}
+	if b.West > b.East || b.South > b.North || b.South < -90 || b.North > 90 || b.West < -180 || b.East > 180 {
+		return BBox{}, errors.New(fmt.Sprintf("invalid bbox: %s", s))
+	}
+
+	return b, nil
+}
+
+func (b BBox) Contains(lat, lon float64) bool {
+	return lat >= b.South && lat <= b.North && lon >= b.West && lon <= b.East
+}
+
+func (b BBox) Center() (float64, float64) {
+	return (b.South + b.North) / 2, (b.West + b.East) / 2
+}
+
+// metersPerDegree is the length of a degree of latitude, close enough for
+// the distances we search over.
+const metersPerDegree = 111320
+
+// RadiusBBox returns a box enclosing the circle of radius meters around a point.
+func RadiusBBox(lat, lon float64, radius int) BBox {
+	dlat := float64(radius) / metersPerDegree
+	dlon := float64(radius) / (metersPerDegree * math.Cos(lat*math.Pi/180))
+
+	return BBox{
+		West:  math.Max(lon-dlon, -180),
+		South: math.Max(lat-dlat, -90),
+		East:  math.Min(lon+dlon, 180),
+		North: math.Min(lat+dlat, 90),
+	}
+}
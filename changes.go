@@ -0,0 +1,186 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"math"
+	"strings"
+	"time"
+)
+
+// Each refresh gets a version, with the stations it added, changed or
+// retired recorded in station_changes for delta syncing clients.
+
+const changesRetention = 24 * time.Hour
+
+// locationTolerance is how far, in degrees, a station can move without
+// being reported as changed, about a centimeter, so that float round trips
+// through the database are not mistaken for moves.
+const locationTolerance = 1e-7
+
+const (
+	stationAdded   = "added"
+	stationChanged = "changed"
+	stationRetired = "retired"
+)
+
+type StationChanges struct {
+	Version int64
+	// set when since is older than the retained changes: Added then holds
+	// every station and clients should replace what they have
+	Resync  bool
+	Added   []Station
+	Changed []Station
+	Retired []int
+}
+
+// currentStations loads the stations as they are before a refresh.
+func currentStations(tx *sql.Tx) (map[int]Station, error) {
+	rows, err := tx.Query("SELECT station_id, name, lat, lon, capacity, bike_count, ebike_count, dock_count FROM stations")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	stations := map[int]Station{}
+	for rows.Next() {
+		var station Station
+		err := rows.Scan(&station.StationId, &station.Name, &station.Lat, &station.Lon, &station.Capacity, &station.BikeCount, &station.EBikeCount, &station.DockCount)
+		if err != nil {
+			return nil, err
+		}
+		stations[station.StationId] = station
+	}
+
+	return stations, rows.Err()
+}
+
+// recordChanges creates a new version and records how the refreshed
+// stations differ from previous, stations gone from the table being retired.
+func recordChanges(tx *sql.Tx, previous map[int]Station, refreshed []Station) error {
+	var version int64
+	err := tx.QueryRow("INSERT INTO refreshes (refreshed_at) VALUES (NOW()) RETURNING version").Scan(&version)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec("DELETE FROM refreshes WHERE refreshed_at < $1", time.Now().Add(-changesRetention))
+	if err != nil {
+		return err
+	}
+
+	changes := refreshChanges(previous, refreshed)
+
+	current, err := currentStations(tx)
+	if err != nil {
+		return err
+	}
+	for id := range previous {
+		_, ok := current[id]
+		if !ok {
+			changes[id] = stationRetired
+		}
+	}
+
+	if len(changes) == 0 {
+		return nil
+	}
+
+	insertQuery := "INSERT INTO station_changes (version, station_id, change) VALUES "
+	for id, change := range changes {
+		insertQuery += fmt.Sprintf("(%d, %d, '%s'),", version, id, change)
+	}
+	_, err = tx.Exec(strings.TrimRight(insertQuery, ","))
+	return err
+}
+
+// refreshChanges tells which refreshed stations are added or changed
+// compared to previous.
+func refreshChanges(previous map[int]Station, refreshed []Station) map[int]string {
+	changes := map[int]string{}
+	for _, station := range refreshed {
+		old, ok := previous[station.StationId]
+		if !ok {
+			changes[station.StationId] = stationAdded
+		} else if old.Name != station.Name || !sameLocation(old, station) || !sameAvailability(old, station) {
+			changes[station.StationId] = stationChanged
+		}
+	}
+	return changes
+}
+
+func sameLocation(a, b Station) bool {
+	return math.Abs(a.Lat-b.Lat) < locationTolerance && math.Abs(a.Lon-b.Lon) < locationTolerance
+}
+
+// changesSince sums up the changes after version since. A station added then
+// changed is added, one retired after being added is left out.
+func changesSince(since int64) (StationChanges, error) {
+	var result StationChanges
+	var oldest sql.NullInt64
+	err := db.QueryRow("SELECT COALESCE(MAX(version), 0), MIN(version) FROM refreshes").Scan(&result.Version, &oldest)
+	if err != nil {
+		return result, err
+	}
+
+	if since > result.Version || !oldest.Valid || since < oldest.Int64-1 {
+		result.Resync = true
+		result.Changed, result.Retired = []Station{}, []int{}
+		result.Added, err = stationsInBBox(BBox{West: -180, South: -90, East: 180, North: 90})
+		return result, err
+	}
+
+	rows, err := db.Query("SELECT station_id, change FROM station_changes WHERE version > $1 AND version <= $2 ORDER BY version", since, result.Version)
+	if err != nil {
+		return result, err
+	}
+	defer rows.Close()
+
+	summary := map[int]string{}
+	for rows.Next() {
+		var id int
+		var change string
+		err := rows.Scan(&id, &change)
+		if err != nil {
+			return result, err
+		}
+
+		switch {
+		case summary[id] == stationAdded && change == stationRetired:
+			delete(summary, id)
+		case summary[id] == stationAdded:
+		case summary[id] == stationRetired && change == stationAdded:
+			summary[id] = stationChanged
+		default:
+			summary[id] = change
+		}
+	}
+	if rows.Err() != nil {
+		return result, rows.Err()
+	}
+
+	result.Added, result.Changed, result.Retired = []Station{}, []Station{}, []int{}
+	if len(summary) == 0 {
+		return result, nil
+	}
+
+	stations, err := stationsInBBox(BBox{West: -180, South: -90, East: 180, North: 90})
+	if err != nil {
+		return result, err
+	}
+	for _, station := range stations {
+		switch summary[station.StationId] {
+		case stationAdded:
+			result.Added = append(result.Added, station)
+		case stationChanged:
+			result.Changed = append(result.Changed, station)
+		}
+	}
+	for id, change := range summary {
+		if change == stationRetired {
+			result.Retired = append(result.Retired, id)
+		}
+	}
+
+	return result, nil
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"strconv"
+	"testing"
+)
+
+func TestRefreshChanges(t *testing.T) {
+	station := Station{StationId: 16107, Name: "Benjamin Godard - Victor Hugo", Lat: 48.865983388243, Lon: 2.2754461877048, Capacity: 35, BikeCount: 4, EBikeCount: 1, DockCount: 31}
+
+	// as stored then read back from the stations table
+	stored := station
+	stored.Lat, _ = strconv.ParseFloat(strconv.FormatFloat(station.Lat, 'f', -1, 64), 64)
+	stored.Lon, _ = strconv.ParseFloat(strconv.FormatFloat(station.Lon, 'f', -1, 64), 64)
+
+	// as a float8 column may give it back to another client
+	rounded := station
+	rounded.Lat, rounded.Lon = station.Lat+1e-12, station.Lon-1e-12
+
+	moved := station
+	moved.Lat += 0.0001
+	emptied := station
+	emptied.BikeCount, emptied.EBikeCount, emptied.DockCount = 0, 0, 35
+	renamed := station
+	renamed.Name = "Benjamin Godard"
+
+	tests := []struct {
+		name      string
+		previous  map[int]Station
+		refreshed Station
+		want      string
+	}{
+		{"unchanged", map[int]Station{station.StationId: station}, station, ""},
+		{"unchanged after a round trip", map[int]Station{station.StationId: stored}, station, ""},
+		{"unchanged but rounded", map[int]Station{station.StationId: rounded}, station, ""},
+		{"added", map[int]Station{}, station, stationAdded},
+		{"moved", map[int]Station{station.StationId: station}, moved, stationChanged},
+		{"emptied", map[int]Station{station.StationId: station}, emptied, stationChanged},
+		{"renamed", map[int]Station{station.StationId: station}, renamed, stationChanged},
+	}
+
+	for _, test := range tests {
+		changes := refreshChanges(test.previous, []Station{test.refreshed})
+		if got := changes[station.StationId]; got != test.want {
+			t.Errorf("%s: change = %q, want %q", test.name, got, test.want)
+		}
+		if test.want == "" && len(changes) != 0 {
+			t.Errorf("%s: changes = %v, want none", test.name, changes)
+		}
+	}
+}
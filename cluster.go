@@ -0,0 +1,62 @@
+package main
+
+import (
+	"math"
+	"slices"
+)
+
+// clusterCellSize is the width in screen pixels of a clustering grid cell.
+const clusterCellSize = 64
+
+type StationCluster struct {
+	Lat          float64
+	Lon          float64
+	StationCount int
+	// set when the cluster holds a single station
+	StationId  int    `json:"station_id,omitempty"`
+	Name       string `json:",omitempty"`
+	BikeCount  int    `json:"numBikesAvailable"`
+	EBikeCount int    `json:"numEBikesAvailable"`
+	DockCount  int    `json:"numDocksAvailable"`
+}
+
+// ClusterStations groups stations falling in the same clusterCellSize grid
+// cell at the given zoom, placing each cluster at its stations' centroid.
+func ClusterStations(stations []Station, zoom int) []StationCluster {
+	type cell struct{ x, y int }
+
+	cells := map[cell]*StationCluster{}
+	var order []cell
+	for _, station := range stations {
+		x, y := mercatorPixel(station.Lat, station.Lon, zoom)
+		key := cell{int(math.Floor(x / clusterCellSize)), int(math.Floor(y / clusterCellSize))}
+
+		cluster, ok := cells[key]
+		if !ok {
+			cluster = &StationCluster{StationId: station.StationId, Name: station.Name}
+			cells[key] = cluster
+			order = append(order, key)
+		} else {
+			cluster.StationId = 0
+			cluster.Name = ""
+		}
+
+		cluster.StationCount++
+		cluster.Lat += station.Lat
+		cluster.Lon += station.Lon
+		cluster.BikeCount += station.BikeCount
+		cluster.EBikeCount += station.EBikeCount
+		cluster.DockCount += station.DockCount
+	}
+
+	clusters := make([]StationCluster, 0, len(order))
+	for _, key := range order {
+		cluster := cells[key]
+		cluster.Lat /= float64(cluster.StationCount)
+		cluster.Lon /= float64(cluster.StationCount)
+		clusters = append(clusters, *cluster)
+	}
+	slices.SortFunc(clusters, func(a StationCluster, b StationCluster) int { return b.StationCount - a.StationCount })
+
+	return clusters
+}
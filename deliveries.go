@@ -0,0 +1,55 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"time"
+)
+
+// Watch events wait in the webhook_deliveries and push_deliveries tables
+// until sent, so they survive restarts and failed attempts.
+
+const (
+	maxDeliveryAttempts = 6
+	deliveryRetryDelay  = 30 * time.Second
+	deliveryPollDelay   = 15 * time.Second
+)
+
+var deliveryWake = make(chan struct{}, 1)
+
+// wakeDeliveries makes the delivery loop run without waiting for its ticker.
+func wakeDeliveries() {
+	select {
+	case deliveryWake <- struct{}{}:
+	default:
+	}
+}
+
+// recordDeliveryAttempt marks a delivery as sent, or schedules its next
+// attempt backing off exponentially.
+func recordDeliveryAttempt(table string, id int, attempts int, sendErr error) error {
+	if sendErr == nil {
+		_, err := db.Exec("UPDATE "+table+" SET attempts = attempts + 1, delivered_at = NOW(), last_error = NULL WHERE id = $1", id)
+		return err
+	}
+
+	delay := deliveryRetryDelay << attempts
+	_, err := db.Exec("UPDATE "+table+" SET attempts = attempts + 1, next_attempt_at = NOW() + $2 * INTERVAL '1 second', last_error = $3 WHERE id = $1", id, int(delay.Seconds()), sendErr.Error())
+	return err
+}
+
+func deliverWatchEvents() {
+	ticker := time.NewTicker(deliveryPollDelay)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-deliveryWake:
+		}
+
+		err := errors.Join(deliverPendingWebhooks(), deliverPendingPushes())
+		if err != nil {
+			log.Print(err)
+		}
+	}
+}
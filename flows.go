@@ -0,0 +1,255 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"math"
+	"sort"
+	"time"
+)
+
+// Trips are inferred from consecutive snapshots: a station losing bikes saw
+// departures, one gaining bikes arrivals. Rebalancing trucks and trips
+// within a refresh interval are indistinguishable from, or hidden among,
+// real trips, so figures are estimates.
+
+const (
+	flowInterval = 15 * time.Minute
+	// intervals this far back are recomputed, as snapshots may come late
+	flowRecompute = 2 * time.Hour
+	// history is backfilled this much at a time
+	flowBackfillChunk = 24 * time.Hour
+	// without areas, neighborhoods are grid cells of about a kilometer
+	flowCellLat = 0.01
+	flowCellLon = 0.015
+	// meters over which the likelihood of a trip decreases by a factor e
+	flowDistanceDecay = 2500
+	maxFlowRange      = 7 * 24 * time.Hour
+)
+
+type StationFlow struct {
+	StationId     int `json:"station_id"`
+	IntervalStart time.Time
+	Departures    int
+	Arrivals      int
+}
+
+// OriginDestinationFlow is the estimated number of trips between two
+// neighborhoods.
+type OriginDestinationFlow struct {
+	Origin      string
+	Destination string
+	Trips       float64
+}
+
+const stationFlowsQuery = `
+INSERT INTO station_flows (station_id, interval_start, departures, arrivals)
+SELECT station_id, to_timestamp(floor(EXTRACT(EPOCH FROM recorded_at) / $3) * $3) AS interval_start,
+	SUM(GREATEST(-delta, 0)), SUM(GREATEST(delta, 0))
+FROM (
+	SELECT station_id, recorded_at, bike_count - LAG(bike_count) OVER (PARTITION BY station_id ORDER BY recorded_at) AS delta
+	FROM station_history
+	WHERE recorded_at > $1 AND recorded_at <= $4
+) deltas
+WHERE delta IS NOT NULL
+GROUP BY 1, 2
+HAVING to_timestamp(floor(EXTRACT(EPOCH FROM MIN(recorded_at)) / $3) * $3) >= $2
+ON CONFLICT (station_id, interval_start) DO UPDATE SET departures = EXCLUDED.departures, arrivals = EXCLUDED.arrivals`
+
+// computeStationFlows infers departures and arrivals from since on, reading
+// one more interval of snapshots for the deltas, a chunk at a time.
+func computeStationFlows(since time.Time) error {
+	now := time.Now()
+	for from := since.Truncate(flowInterval); from.Before(now); from = from.Add(flowBackfillChunk) {
+		_, err := db.Exec(stationFlowsQuery, from.Add(-flowInterval), from, int(flowInterval.Seconds()), from.Add(flowBackfillChunk))
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err := db.Exec("DELETE FROM station_flows WHERE interval_start < $1", now.Add(-historyRetention))
+	return err
+}
+
+// stationFlowsBackfillStart returns where the first computation starts: at
+// the last computed interval, or at the oldest retained snapshot when there
+// is none, so that history recorded while flows were not computed is used.
+func stationFlowsBackfillStart() (time.Time, error) {
+	var last, oldest sql.NullTime
+	err := db.QueryRow("SELECT (SELECT MAX(interval_start) FROM station_flows), (SELECT MIN(recorded_at) FROM station_history)").Scan(&last, &oldest)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	since := time.Now().Add(-flowRecompute)
+	if last.Valid && last.Time.Before(since) {
+		since = last.Time
+	} else if !last.Valid && oldest.Valid {
+		since = oldest.Time
+	}
+	return since, nil
+}
+
+func computeStationFlowsPeriodically() {
+	since, err := stationFlowsBackfillStart()
+	if err != nil {
+		log.Print(err)
+		since = time.Now().Add(-flowRecompute)
+	}
+
+	ticker := time.NewTicker(flowInterval)
+	defer ticker.Stop()
+	for {
+		err := computeStationFlows(since)
+		if err != nil {
+			log.Print(err)
+		} else {
+			since = time.Now().Add(-flowRecompute)
+		}
+		<-ticker.C
+	}
+}
+
+func stationFlows(from, to time.Time, stationId int) ([]StationFlow, error) {
+	query := "SELECT station_id, interval_start, departures, arrivals FROM station_flows WHERE interval_start >= $1 AND interval_start < $2 AND ($3 = 0 OR station_id = $3) ORDER BY interval_start, station_id"
+	rows, err := db.Query(query, from, to, stationId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	flows := []StationFlow{}
+	for rows.Next() {
+		var flow StationFlow
+		err := rows.Scan(&flow.StationId, &flow.IntervalStart, &flow.Departures, &flow.Arrivals)
+		if err != nil {
+			return nil, err
+		}
+		flows = append(flows, flow)
+	}
+
+	return flows, rows.Err()
+}
+
+type neighborhood struct {
+	Name     string
+	Lat, Lon float64
+}
+
+// flowGrouping names the neighborhood of a station for origin-destination
+// flows.
+type flowGrouping func(lat, lon float64) neighborhood
+
+// gridNeighborhood groups stations in grid cells named by their center.
+func gridNeighborhood(lat, lon float64) neighborhood {
+	cellLat := math.Floor(lat/flowCellLat)*flowCellLat + flowCellLat/2
+	cellLon := math.Floor(lon/flowCellLon)*flowCellLon + flowCellLon/2
+	return neighborhood{Name: fmt.Sprintf("%.4f,%.4f", cellLat, cellLon), Lat: cellLat, Lon: cellLon}
+}
+
+// areaNeighborhood groups stations by administrative area, stations outside
+// every area falling back to grid cells.
+func areaNeighborhood(lat, lon float64) neighborhood {
+	area, ok := areaOf(lat, lon)
+	if !ok {
+		return gridNeighborhood(lat, lon)
+	}
+	centerLat, centerLon := area.bbox.Center()
+	return neighborhood{Name: area.Name, Lat: centerLat, Lon: centerLon}
+}
+
+// defaultFlowGrouping uses the administrative areas when they are loaded.
+func defaultFlowGrouping() flowGrouping {
+	if len(areas) > 0 {
+		return areaNeighborhood
+	}
+	return gridNeighborhood
+}
+
+// originDestinationFlows estimates trips between neighborhoods with a
+// gravity model: the departures of an interval are spread over the arrivals
+// of that interval and the next, weighted by exp(-distance / decay).
+func originDestinationFlows(from, to time.Time, neighborhoodOf flowGrouping) ([]OriginDestinationFlow, error) {
+	rows, err := db.Query("SELECT f.interval_start, i.lat, i.lon, f.departures, f.arrivals FROM station_flows f JOIN station_info i ON i.station_id = f.station_id WHERE f.interval_start >= $1 AND f.interval_start < $2", from, to)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	type counts struct{ departures, arrivals float64 }
+	neighborhoods := map[string]neighborhood{}
+	intervals := map[time.Time]map[string]*counts{}
+	for rows.Next() {
+		var start time.Time
+		var lat, lon float64
+		var departures, arrivals int
+		err := rows.Scan(&start, &lat, &lon, &departures, &arrivals)
+		if err != nil {
+			return nil, err
+		}
+
+		n := neighborhoodOf(lat, lon)
+		neighborhoods[n.Name] = n
+		if intervals[start] == nil {
+			intervals[start] = map[string]*counts{}
+		}
+		c := intervals[start][n.Name]
+		if c == nil {
+			c = &counts{}
+			intervals[start][n.Name] = c
+		}
+		c.departures += float64(departures)
+		c.arrivals += float64(arrivals)
+	}
+	if rows.Err() != nil {
+		return nil, rows.Err()
+	}
+
+	trips := map[[2]string]float64{}
+	for start, origins := range intervals {
+		arrivals := map[string]float64{}
+		for _, interval := range []time.Time{start, start.Add(flowInterval)} {
+			for name, c := range intervals[interval] {
+				arrivals[name] += c.arrivals
+			}
+		}
+
+		for originName, origin := range origins {
+			if origin.departures == 0 {
+				continue
+			}
+
+			attraction := map[string]float64{}
+			var total float64
+			for destinationName, count := range arrivals {
+				o, d := neighborhoods[originName], neighborhoods[destinationName]
+				a := count * math.Exp(-float64(Haversine(o.Lat, o.Lon, d.Lat, d.Lon))/flowDistanceDecay)
+				attraction[destinationName] = a
+				total += a
+			}
+			if total == 0 {
+				continue
+			}
+
+			for destinationName, a := range attraction {
+				trips[[2]string{originName, destinationName}] += origin.departures * a / total
+			}
+		}
+	}
+
+	flows := []OriginDestinationFlow{}
+	for key, count := range trips {
+		if count >= 0.05 {
+			flows = append(flows, OriginDestinationFlow{Origin: key[0], Destination: key[1], Trips: math.Round(count*10) / 10})
+		}
+	}
+	sort.Slice(flows, func(i, j int) bool {
+		if flows[i].Trips != flows[j].Trips {
+			return flows[i].Trips > flows[j].Trips
+		}
+		return flows[i].Origin+flows[i].Destination < flows[j].Origin+flows[j].Destination
+	})
+
+	return flows, nil
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const gbfsBaseUrl = "https://velib-metropole-opendata.smovengo.cloud/opendata/Velib_Metropole/"
+
+// fetchGbfsFeed decodes the GBFS feed of the given name, such as
+// "station_status", into v.
+func fetchGbfsFeed(name string, v any) error {
+	r, err := http.Get(gbfsBaseUrl + name + ".json")
+	if err != nil {
+		return err
+	}
+	defer r.Body.Close()
+
+	if r.StatusCode != http.StatusOK {
+		return errors.New(fmt.Sprintf("fetching %s: %s", name, r.Status))
+	}
+
+	return json.NewDecoder(r.Body).Decode(v)
+}
+
+// localizedText reads a GBFS text field, either a plain string (GBFS 2) or
+// a list of translations (GBFS 3), preferring French.
+func localizedText(raw json.RawMessage) string {
+	var text string
+	if json.Unmarshal(raw, &text) == nil {
+		return text
+	}
+
+	var translations []struct {
+		Text     string
+		Language string
+	}
+	if json.Unmarshal(raw, &translations) != nil || len(translations) == 0 {
+		return ""
+	}
+	for _, translation := range translations {
+		if strings.HasPrefix(translation.Language, "fr") {
+			return translation.Text
+		}
+	}
+	return translations[0].Text
+}
+
+// gbfsFloat reads a GBFS number, which older feeds encode as a string.
+func gbfsFloat(raw json.RawMessage) (float64, error) {
+	if len(raw) == 0 {
+		return 0, nil
+	}
+	return strconv.ParseFloat(strings.Trim(string(raw), `"`), 64)
+}
+
+// gbfsId reads a GBFS identifier, which some feeds encode as a number.
+type gbfsId string
+
+func (id *gbfsId) UnmarshalJSON(data []byte) error {
+	if string(data) == "null" {
+		*id = ""
+		return nil
+	}
+	*id = gbfsId(strings.Trim(string(data), `"`))
+	return nil
+}
+
+// gbfsTime reads a GBFS timestamp, either POSIX seconds (GBFS 2) or
+// RFC 3339 (GBFS 3).
+func gbfsTime(raw json.RawMessage) (time.Time, error) {
+	var seconds int64
+	if json.Unmarshal(raw, &seconds) == nil {
+		return time.Unix(seconds, 0), nil
+	}
+
+	var t time.Time
+	err := json.Unmarshal(raw, &t)
+	return t, err
+}
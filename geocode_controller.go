@@ -0,0 +1,87 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+)
+
+const (
+	defaultGeocodeLimit  = 5
+	maxGeocodeLimit      = 20
+	defaultReverseRadius = 100
+	maxReverseRadius     = 1000
+)
+
+type GeocodeController struct{}
+
+func geocoderUnavailable(w http.ResponseWriter) {
+	http.Error(w, "address geocoding is not available", http.StatusServiceUnavailable)
+}
+
+func writeAddresses(w http.ResponseWriter, addresses []Address) {
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(addresses)
+	if err != nil {
+		defer handleHttpError(w, err)
+		return
+	}
+}
+
+// Search geocodes the q address, with autocomplete=true completing its last
+// word.
+func (c *GeocodeController) Search(w http.ResponseWriter, r *http.Request) {
+	params := r.URL.Query()
+	g := addressGeocoder.Load()
+	if g == nil {
+		geocoderUnavailable(w)
+		return
+	}
+
+	query := params.Get("q")
+	if query == "" {
+		defer handleHttpBadRequest(w, errors.New("q is required"))
+		return
+	}
+
+	limit, err := optionalInt(params, "limit", defaultGeocodeLimit)
+	if err != nil {
+		defer handleHttpBadRequest(w, err)
+		return
+	}
+	limit = min(max(limit, 1), maxGeocodeLimit)
+
+	writeAddresses(w, g.Geocode(query, limit, params.Get("autocomplete") == "true"))
+}
+
+// Reverse returns the addresses closest to a location.
+func (c *GeocodeController) Reverse(w http.ResponseWriter, r *http.Request) {
+	params := r.URL.Query()
+	g := addressGeocoder.Load()
+	if g == nil {
+		geocoderUnavailable(w)
+		return
+	}
+
+	location, err := parseLocationParams(params)
+	if err != nil {
+		defer handleHttpBadRequest(w, err)
+		return
+	}
+
+	radius, err := optionalInt(params, "radius", defaultReverseRadius)
+	if err != nil {
+		defer handleHttpBadRequest(w, err)
+		return
+	}
+	radius = min(max(radius, 1), maxReverseRadius)
+
+	limit, err := optionalInt(params, "limit", defaultGeocodeLimit)
+	if err != nil {
+		defer handleHttpBadRequest(w, err)
+		return
+	}
+	limit = min(max(limit, 1), maxGeocodeLimit)
+
+	writeAddresses(w, g.Reverse(location, radius, limit))
+}
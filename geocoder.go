@@ -0,0 +1,360 @@
+package main
+
+import (
+	"compress/gzip"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"os"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// The geocoder indexes a Base Adresse Nationale CSV extract in memory:
+// streets by the trigrams of their name and commune, their addresses by
+// house number, and every address on a grid for reverse geocoding.
+
+const (
+	// grid cells used for reverse geocoding, in degrees
+	addressGridCell = 0.001
+	// BAN house number of named places which are not addresses
+	banToponymNumber = "99999"
+	// matches scoring less are not worth returning
+	minGeocodeScore = 0.4
+	// street candidates looked at per result asked for
+	geocodeCandidates = 5
+	// a free text location resolves to its best address only above this
+	minLocationScore = 0.6
+)
+
+type Address struct {
+	// house number with its suffix, such as "12 bis", empty for a street
+	Number   string `json:",omitempty"`
+	Street   string
+	Postcode string
+	City     string
+	Label    string
+	Lat      float64
+	Lon      float64
+	Score    float64 `json:",omitempty"`
+	Distance int     `json:",omitempty"`
+}
+
+type addressStreet struct {
+	Name     string
+	Postcode string
+	City     string
+	// centroid of its addresses
+	Lat, Lon float64
+	numbers  map[string]int32
+}
+
+type geocoder struct {
+	addresses []Address
+	streets   []addressStreet
+	index     *trigramIndex
+	grid      map[[2]int32][]int32
+}
+
+// addressGeocoder is set once the extract named by VELIB_BAN_FILE is
+// loaded. Until then, or without extract, addresses cannot be geocoded.
+var addressGeocoder atomic.Pointer[geocoder]
+
+func loadAddressGeocoder() {
+	path := os.Getenv("VELIB_BAN_FILE")
+	if path == "" {
+		return
+	}
+
+	started := time.Now()
+	g, err := loadGeocoder(path)
+	if err != nil {
+		log.Print(err)
+		return
+	}
+	addressGeocoder.Store(g)
+	log.Printf("loaded %d addresses of %d streets from %s in %s", len(g.addresses), len(g.streets), path, time.Since(started).Round(time.Second))
+}
+
+// streetAbbreviations are expanded in queries and street names alike.
+var streetAbbreviations = map[string]string{
+	"r": "rue", "av": "avenue", "ave": "avenue", "bd": "boulevard", "bld": "boulevard", "boul": "boulevard",
+	"pl": "place", "st": "saint", "ste": "sainte", "fg": "faubourg", "fbg": "faubourg", "imp": "impasse",
+	"sq": "square", "qu": "quai", "ch": "chemin", "che": "chemin", "all": "allee", "pass": "passage",
+	"rte": "route", "crs": "cours", "prom": "promenade", "vla": "villa", "gal": "galerie", "pte": "porte",
+}
+
+func foldStreet(s string) string {
+	words := strings.Fields(foldText(s))
+	for i, word := range words {
+		if expanded, ok := streetAbbreviations[word]; ok {
+			words[i] = expanded
+		}
+	}
+	return strings.Join(words, " ")
+}
+
+func addressGridCellOf(lat, lon float64) [2]int32 {
+	return [2]int32{int32(math.Floor(lat / addressGridCell)), int32(math.Floor(lon / addressGridCell))}
+}
+
+func addressLabel(number, street, postcode, city string) string {
+	return strings.TrimSpace(strings.Join(strings.Fields(fmt.Sprintf("%s %s %s %s", number, street, postcode, city)), " "))
+}
+
+// loadGeocoder reads a BAN CSV extract, possibly gzipped, such as
+// adresses-75.csv.gz from adresse.data.gouv.fr.
+func loadGeocoder(path string) (*geocoder, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var r io.Reader = f
+	if strings.HasSuffix(path, ".gz") {
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			return nil, err
+		}
+		defer gz.Close()
+		r = gz
+	}
+
+	records := csv.NewReader(r)
+	records.Comma = ';'
+	records.ReuseRecord = true
+	header, err := records.Read()
+	if err != nil {
+		return nil, err
+	}
+	columns := map[string]int{}
+	for i, name := range header {
+		columns[strings.TrimPrefix(name, "\ufeff")] = i
+	}
+	for _, name := range []string{"numero", "rep", "nom_voie", "code_postal", "nom_commune", "lon", "lat"} {
+		if _, ok := columns[name]; !ok {
+			return nil, errors.New(fmt.Sprintf("%s: missing column %s", path, name))
+		}
+	}
+
+	g := &geocoder{index: newTrigramIndex(), grid: map[[2]int32][]int32{}}
+	streets := map[string]int32{}
+	// sums of coordinates and counts for street centroids
+	sums := [][3]float64{}
+	for {
+		record, err := records.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		lat, err := strconv.ParseFloat(record[columns["lat"]], 64)
+		if err != nil {
+			continue
+		}
+		lon, err := strconv.ParseFloat(record[columns["lon"]], 64)
+		if err != nil {
+			continue
+		}
+
+		name, postcode, city := record[columns["nom_voie"]], record[columns["code_postal"]], record[columns["nom_commune"]]
+		key := foldStreet(name) + "|" + postcode
+		s, ok := streets[key]
+		if !ok {
+			s = int32(len(g.streets))
+			streets[key] = s
+			// fields share the memory of their whole record otherwise
+			g.streets = append(g.streets, addressStreet{Name: strings.Clone(name), Postcode: strings.Clone(postcode), City: strings.Clone(city), numbers: map[string]int32{}})
+			sums = append(sums, [3]float64{})
+			g.index.Add(foldStreet(name + " " + city))
+		}
+		sums[s][0] += lat
+		sums[s][1] += lon
+		sums[s][2]++
+
+		number := record[columns["numero"]]
+		if number == "" || number == banToponymNumber {
+			continue
+		}
+		number = strings.Clone(strings.TrimSpace(number + " " + strings.ToLower(record[columns["rep"]])))
+
+		a := int32(len(g.addresses))
+		street := &g.streets[s]
+		g.addresses = append(g.addresses, Address{Number: number, Street: street.Name, Postcode: street.Postcode, City: street.City, Label: addressLabel(number, street.Name, postcode, city), Lat: lat, Lon: lon})
+		street.numbers[number] = a
+		cell := addressGridCellOf(lat, lon)
+		g.grid[cell] = append(g.grid[cell], a)
+	}
+
+	for i := range g.streets {
+		g.streets[i].Lat = sums[i][0] / sums[i][2]
+		g.streets[i].Lon = sums[i][1] / sums[i][2]
+	}
+
+	return g, nil
+}
+
+var (
+	houseNumberPattern = regexp.MustCompile(`^(\d+)\s*(bis|ter|quater|quinquies|[a-z](?:\s|$))?\s*`)
+	postcodePattern    = regexp.MustCompile(`\b(\d{5})\b`)
+)
+
+// houseNumberSuffixes are the single letters often written for the suffixes
+// the BAN spells out.
+var houseNumberSuffixes = map[string]string{"b": "bis", "t": "ter", "q": "quater"}
+
+// houseNumberAlias returns the spelled out form of a house number with a
+// single letter suffix, such as "13 bis" for "13 b", or the number itself.
+func houseNumberAlias(number string) string {
+	value, suffix, ok := strings.Cut(number, " ")
+	if long, found := houseNumberSuffixes[suffix]; ok && found {
+		return value + " " + long
+	}
+	return number
+}
+
+// Geocode returns the addresses best matching a free text query such as
+// "12 rue de Rivoli 75004 Paris", best first. With partial, the last word
+// is taken as a prefix, for autocompletion as the user types.
+func (g *geocoder) Geocode(query string, limit int, partial bool) []Address {
+	text := foldStreet(query)
+
+	postcode := ""
+	if match := postcodePattern.FindStringSubmatch(text); match != nil {
+		postcode = match[1]
+		text = strings.TrimSpace(strings.Replace(text, match[0], " ", 1))
+	}
+	number := ""
+	if match := houseNumberPattern.FindStringSubmatch(text); match != nil {
+		number = strings.TrimSpace(match[1] + " " + strings.TrimSpace(match[2]))
+		text = text[len(match[0]):]
+	}
+	if strings.TrimSpace(text) == "" {
+		return []Address{}
+	}
+
+	addresses := []Address{}
+	for _, match := range g.index.Search(text, partial, minGeocodeScore) {
+		if len(addresses) >= limit*geocodeCandidates {
+			break
+		}
+		street := g.streets[match.Doc]
+		if postcode != "" && street.Postcode != postcode {
+			continue
+		}
+
+		address, ok := street.address(g, number)
+		if !ok {
+			continue
+		}
+		address.Score = math.Round(match.Score*1000) / 1000
+		if address.Number != number && address.Number != houseNumberAlias(number) {
+			// close enough, but not the number asked for
+			address.Score = math.Round(match.Score*900) / 1000
+		}
+		addresses = append(addresses, address)
+	}
+
+	slices.SortStableFunc(addresses, func(a Address, b Address) int {
+		if a.Score > b.Score {
+			return -1
+		}
+		if a.Score < b.Score {
+			return 1
+		}
+		return 0
+	})
+	if len(addresses) > limit {
+		addresses = addresses[:limit]
+	}
+	return addresses
+}
+
+// address returns the address of a street at a house number, the closest
+// number on the same side when it does not exist, or the street itself
+// without number.
+func (s addressStreet) address(g *geocoder, number string) (Address, bool) {
+	if number == "" {
+		return Address{Street: s.Name, Postcode: s.Postcode, City: s.City, Label: addressLabel("", s.Name, s.Postcode, s.City), Lat: s.Lat, Lon: s.Lon}, true
+	}
+
+	if a, ok := s.numbers[number]; ok {
+		return g.addresses[a], true
+	}
+	if a, ok := s.numbers[houseNumberAlias(number)]; ok {
+		return g.addresses[a], true
+	}
+
+	wanted, _ := strconv.Atoi(strings.Fields(number)[0])
+	best, bestGap := int32(-1), math.MaxInt
+	for n, a := range s.numbers {
+		value, err := strconv.Atoi(strings.Fields(n)[0])
+		if err != nil {
+			continue
+		}
+		gap := max(value-wanted, wanted-value)
+		if (value-wanted)%2 != 0 {
+			// the other side of the street
+			gap += 1000
+		}
+		if gap < bestGap || (gap == bestGap && a < best) {
+			best, bestGap = a, gap
+		}
+	}
+	if best < 0 {
+		return Address{}, false
+	}
+	return g.addresses[best], true
+}
+
+// Reverse returns the addresses within radius meters of a point, closest
+// first.
+func (g *geocoder) Reverse(location latLon, radius int, limit int) []Address {
+	bbox := RadiusBBox(location.Lat, location.Lon, radius)
+	from := addressGridCellOf(bbox.South, bbox.West)
+	to := addressGridCellOf(bbox.North, bbox.East)
+
+	addresses := []Address{}
+	for y := from[0]; y <= to[0]; y++ {
+		for x := from[1]; x <= to[1]; x++ {
+			for _, a := range g.grid[[2]int32{y, x}] {
+				address := g.addresses[a]
+				address.Distance = Haversine(location.Lat, location.Lon, address.Lat, address.Lon)
+				if address.Distance <= radius {
+					addresses = append(addresses, address)
+				}
+			}
+		}
+	}
+
+	slices.SortStableFunc(addresses, func(a Address, b Address) int { return a.Distance - b.Distance })
+	if len(addresses) > limit {
+		addresses = addresses[:limit]
+	}
+	return addresses
+}
+
+// geocodeLocation resolves a free text address to its best match, when the
+// geocoder is loaded and the match is good enough.
+func geocodeLocation(s string) (latLon, bool) {
+	g := addressGeocoder.Load()
+	if g == nil {
+		return latLon{}, false
+	}
+
+	addresses := g.Geocode(s, 1, false)
+	if len(addresses) == 0 || addresses[0].Score < minLocationScore {
+		return latLon{}, false
+	}
+	return latLon{Lat: addresses[0].Lat, Lon: addresses[0].Lon}, true
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"slices"
+	"strings"
+	"sync/atomic"
+)
+
+// When the browser does not share its position, the client's IP address
+// gives an approximate one, from the MaxMind format database named by
+// VELIB_GEOIP_FILE, such as GeoLite2-City.mmdb.
+
+// GeoIpLocation is where an IP address is believed to be, within
+// AccuracyRadius kilometers.
+type GeoIpLocation struct {
+	Lat            float64
+	Lon            float64
+	AccuracyRadius int    `json:",omitempty"`
+	City           string `json:",omitempty"`
+	Country        string `json:",omitempty"`
+}
+
+var geoIpDatabase atomic.Pointer[mmdbReader]
+
+func loadGeoIpDatabase() error {
+	path := os.Getenv("VELIB_GEOIP_FILE")
+	if path == "" {
+		return nil
+	}
+
+	r, err := openMmdb(path)
+	if err != nil {
+		return err
+	}
+	geoIpDatabase.Store(r)
+	return nil
+}
+
+// trustedProxies are the reverse proxies whose X-Forwarded-For is believed,
+// besides loopback ones: the addresses or prefixes, comma separated, of
+// VELIB_TRUSTED_PROXY.
+var trustedProxies []netip.Prefix
+
+func loadTrustedProxies() error {
+	trustedProxies = nil
+	for _, value := range strings.Split(os.Getenv("VELIB_TRUSTED_PROXY"), ",") {
+		value = strings.TrimSpace(value)
+		if value == "" {
+			continue
+		}
+		prefix, err := netip.ParsePrefix(value)
+		if err != nil {
+			addr, addrErr := netip.ParseAddr(value)
+			if addrErr != nil {
+				return errors.New(fmt.Sprintf("invalid VELIB_TRUSTED_PROXY address: %s", value))
+			}
+			prefix = netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen())
+		}
+		trustedProxies = append(trustedProxies, prefix.Masked())
+	}
+	return nil
+}
+
+func trustedProxy(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	return addr.IsLoopback() || slices.ContainsFunc(trustedProxies, func(prefix netip.Prefix) bool { return prefix.Contains(addr) })
+}
+
+// clientAddr returns the IP address of a client. X-Forwarded-For is only
+// trusted from a loopback or configured reverse proxy, as anyone else could
+// spoof their location with it.
+func clientAddr(r *http.Request) (netip.Addr, bool) {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return netip.Addr{}, false
+	}
+
+	if forwarded := r.Header.Get("X-Forwarded-For"); forwarded != "" && trustedProxy(addr) {
+		// the last address is the one the proxy saw
+		hops := strings.Split(forwarded, ",")
+		proxied, err := netip.ParseAddr(strings.TrimSpace(hops[len(hops)-1]))
+		if err == nil {
+			addr = proxied
+		}
+	}
+	return addr, true
+}
+
+// mmdbPath walks maps of decoded MaxMind DB data along keys.
+func mmdbPath(value any, keys ...string) any {
+	for _, key := range keys {
+		m, ok := value.(map[string]any)
+		if !ok {
+			return nil
+		}
+		value = m[key]
+	}
+	return value
+}
+
+func mmdbName(value any) string {
+	for _, language := range []string{"fr", "en"} {
+		name, ok := mmdbPath(value, "names", language).(string)
+		if ok {
+			return name
+		}
+	}
+	return ""
+}
+
+// locateClient estimates the location of a client from its IP address.
+func locateClient(r *http.Request) (*GeoIpLocation, bool) {
+	database := geoIpDatabase.Load()
+	if database == nil {
+		return nil, false
+	}
+	addr, ok := clientAddr(r)
+	if !ok {
+		return nil, false
+	}
+
+	record, err := database.Lookup(addr)
+	if err != nil {
+		log.Print(err)
+		return nil, false
+	}
+	lat, latOk := mmdbPath(record, "location", "latitude").(float64)
+	lon, lonOk := mmdbPath(record, "location", "longitude").(float64)
+	if !latOk || !lonOk {
+		return nil, false
+	}
+
+	location := &GeoIpLocation{Lat: lat, Lon: lon, City: mmdbName(mmdbPath(record, "city")), Country: mmdbName(mmdbPath(record, "country"))}
+	if radius, ok := mmdbPath(record, "location", "accuracy_radius").(uint64); ok {
+		location.AccuracyRadius = int(radius)
+	}
+	return location, true
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+)
+
+func TestClientAddr(t *testing.T) {
+	t.Setenv("VELIB_TRUSTED_PROXY", "10.0.0.2, 192.168.1.0/24")
+	err := loadTrustedProxies()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { trustedProxies = nil })
+
+	tests := []struct {
+		remoteAddr string
+		forwarded  string
+		want       string
+	}{
+		{"203.0.113.7:51234", "", "203.0.113.7"},
+		{"127.0.0.1:51234", "198.51.100.1, 203.0.113.7", "203.0.113.7"},
+		{"[::1]:51234", "203.0.113.7", "203.0.113.7"},
+		{"10.0.0.2:51234", "203.0.113.7", "203.0.113.7"},
+		{"192.168.1.20:51234", "203.0.113.7", "203.0.113.7"},
+		// other clients, even on a private network, cannot choose theirs
+		{"10.0.0.3:51234", "203.0.113.7", "10.0.0.3"},
+		{"172.17.0.5:51234", "203.0.113.7", "172.17.0.5"},
+		{"198.51.100.1:51234", "203.0.113.7", "198.51.100.1"},
+		{"127.0.0.1:51234", "not an address", "127.0.0.1"},
+	}
+
+	for _, test := range tests {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = test.remoteAddr
+		if test.forwarded != "" {
+			r.Header.Set("X-Forwarded-For", test.forwarded)
+		}
+		got, ok := clientAddr(r)
+		if !ok || got != netip.MustParseAddr(test.want) {
+			t.Errorf("clientAddr from %s forwarding %q = %s, want %s", test.remoteAddr, test.forwarded, got, test.want)
+		}
+	}
+
+	t.Setenv("VELIB_TRUSTED_PROXY", "proxy.local")
+	if loadTrustedProxies() == nil {
+		t.Error("invalid VELIB_TRUSTED_PROXY was accepted")
+	}
+}
@@ -8,7 +8,32 @@ import (
 
 type IndexController struct{}
 
+type IndexPage struct {
+	// active alerts concerning the whole system, shown as a banner
+	Alerts []Alert
+	// where the map starts, the client's approximate location when known
+	Center latLon
+	Zoom   int
+}
+
 func (i *IndexController) Show(w http.ResponseWriter, r *http.Request) {
+	page := IndexPage{Center: parisCenter, Zoom: 11}
+	if approximate, ok := locateClient(r); ok {
+		page.Center = latLon{Lat: approximate.Lat, Lon: approximate.Lon}
+		page.Zoom = 13
+	}
+
+	alerts, err := activeAlerts()
+	if err != nil {
+		// the page is still useful without alerts
+		log.Print(err)
+	}
+	for _, alert := range alerts {
+		if alert.SystemWide() {
+			page.Alerts = append(page.Alerts, alert)
+		}
+	}
+
 	tmpl, err := template.ParseFiles("index.html")
 	if err != nil {
 		http.Error(w, http.StatusText(http.StatusInternalServerError),
@@ -17,7 +42,7 @@ func (i *IndexController) Show(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err = tmpl.Execute(w, nil)
+	err = tmpl.Execute(w, page)
 	if err != nil {
 		http.Error(w, http.StatusText(http.StatusInternalServerError),
 			http.StatusInternalServerError)
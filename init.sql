@@ -1 +1,41 @@
 CREATE UNLOGGED TABLE IF NOT EXISTS stations (id SERIAL PRIMARY KEY, station_id bigint NOT NULL UNIQUE, name text NOT NULL, lat double precision NOT NULL, lon double precision NOT NULL, bike_count int NOT NULL DEFAULT 0, dock_count int NOT NULL DEFAULT 0, updated_at timestamp WITH time zone);
+ALTER TABLE stations ADD COLUMN IF NOT EXISTS capacity int NOT NULL DEFAULT 0;
+ALTER TABLE stations ADD COLUMN IF NOT EXISTS ebike_count int NOT NULL DEFAULT 0;
+
+CREATE TABLE IF NOT EXISTS station_history (station_id bigint NOT NULL, bike_count int NOT NULL, ebike_count int NOT NULL, dock_count int NOT NULL, recorded_at timestamp WITH time zone NOT NULL);
+CREATE INDEX IF NOT EXISTS station_history_station_id_recorded_at ON station_history (station_id, recorded_at);
+
+CREATE INDEX IF NOT EXISTS stations_lat_lon ON stations (lat, lon);
+
+CREATE TABLE IF NOT EXISTS watches (id SERIAL PRIMARY KEY, station_id bigint, lat double precision, lon double precision, radius int, kind text NOT NULL, threshold int NOT NULL, webhook_url text NOT NULL, secret text NOT NULL, created_at timestamp WITH time zone NOT NULL DEFAULT NOW(), expires_at timestamp WITH time zone NOT NULL, triggered_at timestamp WITH time zone);
+CREATE TABLE IF NOT EXISTS webhook_deliveries (id SERIAL PRIMARY KEY, watch_id int NOT NULL REFERENCES watches (id) ON DELETE CASCADE, payload text NOT NULL, attempts int NOT NULL DEFAULT 0, next_attempt_at timestamp WITH time zone NOT NULL DEFAULT NOW(), delivered_at timestamp WITH time zone, last_error text);
+CREATE INDEX IF NOT EXISTS webhook_deliveries_pending ON webhook_deliveries (next_attempt_at) WHERE delivered_at IS NULL;
+
+CREATE TABLE IF NOT EXISTS push_subscriptions (id SERIAL PRIMARY KEY, endpoint text NOT NULL UNIQUE, p256dh text NOT NULL, auth text NOT NULL, created_at timestamp WITH time zone NOT NULL DEFAULT NOW());
+ALTER TABLE watches ALTER COLUMN webhook_url DROP NOT NULL;
+ALTER TABLE watches ADD COLUMN IF NOT EXISTS push_subscription_id int REFERENCES push_subscriptions (id) ON DELETE CASCADE;
+CREATE TABLE IF NOT EXISTS push_deliveries (id SERIAL PRIMARY KEY, watch_id int NOT NULL REFERENCES watches (id) ON DELETE CASCADE, payload text NOT NULL, attempts int NOT NULL DEFAULT 0, next_attempt_at timestamp WITH time zone NOT NULL DEFAULT NOW(), delivered_at timestamp WITH time zone, last_error text);
+CREATE INDEX IF NOT EXISTS push_deliveries_pending ON push_deliveries (next_attempt_at) WHERE delivered_at IS NULL;
+
+CREATE TABLE IF NOT EXISTS refreshes (version bigserial PRIMARY KEY, refreshed_at timestamp WITH time zone NOT NULL);
+CREATE TABLE IF NOT EXISTS station_changes (version bigint NOT NULL REFERENCES refreshes (version) ON DELETE CASCADE, station_id bigint NOT NULL, change text NOT NULL, PRIMARY KEY (version, station_id));
+
+CREATE TABLE IF NOT EXISTS station_info (station_id bigint PRIMARY KEY, name text NOT NULL, lat double precision NOT NULL, lon double precision NOT NULL, capacity int NOT NULL, last_seen_at timestamp WITH time zone NOT NULL);
+INSERT INTO station_info (station_id, name, lat, lon, capacity, last_seen_at) SELECT station_id, name, lat, lon, capacity, updated_at FROM stations ON CONFLICT DO NOTHING;
+CREATE INDEX IF NOT EXISTS station_history_recorded_at ON station_history (recorded_at);
+
+CREATE TABLE IF NOT EXISTS station_reliability (station_id bigint NOT NULL, weekday int NOT NULL, hour int NOT NULL, samples int NOT NULL, empty_share double precision NOT NULL, full_share double precision NOT NULL, empty_recovery_minutes double precision, full_recovery_minutes double precision, PRIMARY KEY (station_id, weekday, hour));
+
+CREATE TABLE IF NOT EXISTS station_flows (station_id bigint NOT NULL, interval_start timestamp WITH time zone NOT NULL, departures int NOT NULL, arrivals int NOT NULL, PRIMARY KEY (station_id, interval_start));
+CREATE INDEX IF NOT EXISTS station_flows_interval_start ON station_flows (interval_start);
+
+CREATE TABLE IF NOT EXISTS pricing_plans (plan_id text PRIMARY KEY, name text NOT NULL, currency text NOT NULL, price double precision NOT NULL, description text NOT NULL, bike text NOT NULL, per_min_pricing jsonb NOT NULL, updated_at timestamp WITH time zone NOT NULL);
+
+ALTER TABLE stations ADD COLUMN IF NOT EXISTS region_id text NOT NULL DEFAULT '';
+CREATE TABLE IF NOT EXISTS alerts (alert_id text PRIMARY KEY, type text NOT NULL, summary text NOT NULL, description text NOT NULL, url text NOT NULL, last_updated timestamp WITH time zone, updated_at timestamp WITH time zone NOT NULL);
+CREATE TABLE IF NOT EXISTS alert_times (alert_id text NOT NULL REFERENCES alerts (alert_id) ON DELETE CASCADE, starts_at timestamp WITH time zone NOT NULL, ends_at timestamp WITH time zone);
+CREATE TABLE IF NOT EXISTS alert_stations (alert_id text NOT NULL REFERENCES alerts (alert_id) ON DELETE CASCADE, station_id bigint NOT NULL, PRIMARY KEY (alert_id, station_id));
+CREATE TABLE IF NOT EXISTS alert_regions (alert_id text NOT NULL REFERENCES alerts (alert_id) ON DELETE CASCADE, region_id text NOT NULL, PRIMARY KEY (alert_id, region_id));
+
+CREATE TABLE IF NOT EXISTS station_areas (station_id bigint PRIMARY KEY, area_id text NOT NULL);
+CREATE INDEX IF NOT EXISTS station_areas_area_id ON station_areas (area_id);
@@ -0,0 +1,457 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Locations can be given as decimal degrees, degrees minutes seconds,
+// Open Location Codes (plus codes), geohashes, Lambert-93 coordinates as
+// used by Paris open data, or links to a map showing the location.
+
+// parisCenter is the reference short plus codes are relative to.
+var parisCenter = latLon{Lat: 48.864716, Lon: 2.349014}
+
+// parseLocation reads a location in any of the supported formats.
+func parseLocation(s string) (latLon, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return latLon{}, errors.New("location is required")
+	}
+
+	var location latLon
+	var err error
+	switch {
+	case strings.HasPrefix(strings.ToLower(s), "geo:") || strings.Contains(s, "://"):
+		location, err = parseMapUrl(s)
+	case plusCodePattern.MatchString(s):
+		location, err = decodePlusCode(s, parisCenter)
+	case strings.ContainsAny(s, "°º"):
+		location, err = parseDms(s)
+	case isGeohash(s):
+		location, err = decodeGeohash(s)
+	default:
+		location, err = parseCoordinatePair(s)
+		if err != nil {
+			// anything else may be an address
+			if geocoded, ok := geocodeLocation(s); ok {
+				location, err = geocoded, nil
+			}
+		}
+	}
+	if err != nil {
+		return latLon{}, err
+	}
+
+	if location.Lat < -90 || location.Lat > 90 || location.Lon < -180 || location.Lon > 180 || math.IsNaN(location.Lat) || math.IsNaN(location.Lon) {
+		return latLon{}, errors.New(fmt.Sprintf("invalid location: %s", s))
+	}
+	return location, nil
+}
+
+// parseLocationParams reads the location of a query, either from location
+// in any supported format, or from decimal latitude and longitude.
+func parseLocationParams(params url.Values) (latLon, error) {
+	if params.Has("location") {
+		return parseLocation(params.Get("location"))
+	}
+	if !params.Has("latitude") || !params.Has("longitude") {
+		return latLon{}, errors.New("location or latitude and longitude are required")
+	}
+
+	lat, err := strconv.ParseFloat(params.Get("latitude"), 64)
+	if err != nil {
+		return latLon{}, err
+	}
+	lon, err := strconv.ParseFloat(params.Get("longitude"), 64)
+	if err != nil {
+		return latLon{}, err
+	}
+	if lat < -90 || lat > 90 || lon < -180 || lon > 180 || math.IsNaN(lat) || math.IsNaN(lon) {
+		return latLon{}, errors.New("latitude or longitude out of range")
+	}
+
+	return latLon{Lat: lat, Lon: lon}, nil
+}
+
+func hasLocationParams(params url.Values) bool {
+	return params.Has("location") || params.Has("latitude") || params.Has("longitude")
+}
+
+var coordinatePairPattern = regexp.MustCompile(`^(?i)(?:(?:epsg:2154|lambert-?93|l93)\s*:?\s*)?x?=?\s*([-+]?\d+(?:\.\d+)?)\s*(?:[,; ]|\s)\s*y?=?\s*([-+]?\d+(?:\.\d+)?)$`)
+
+// parseCoordinatePair reads "latitude,longitude" in decimal degrees, or
+// "x,y" Lambert-93 meters, told apart by their magnitude.
+func parseCoordinatePair(s string) (latLon, error) {
+	match := coordinatePairPattern.FindStringSubmatch(s)
+	if match == nil {
+		return latLon{}, errors.New(fmt.Sprintf("invalid location: %s", s))
+	}
+
+	a, err := strconv.ParseFloat(match[1], 64)
+	if err != nil {
+		return latLon{}, err
+	}
+	b, err := strconv.ParseFloat(match[2], 64)
+	if err != nil {
+		return latLon{}, err
+	}
+
+	if math.Abs(a) <= 90 && math.Abs(b) <= 180 {
+		return latLon{Lat: a, Lon: b}, nil
+	}
+	if a >= 0 && a <= 1300000 && b >= 6000000 && b <= 7200000 {
+		return lambert93ToWgs84(a, b), nil
+	}
+	return latLon{}, errors.New(fmt.Sprintf("invalid location: %s", s))
+}
+
+// Hemisphere letters, O standing for ouest, come either before or after
+// the coordinates, the patterns capturing them in the first or last group.
+var (
+	dmsPrefixPattern = regexp.MustCompile(`(?i)([NSEWO])\s*(-?\d+(?:\.\d+)?)\s*[°º]\s*(?:(\d+(?:\.\d+)?)\s*'\s*)?(?:(\d+(?:\.\d+)?)\s*"\s*)?()`)
+	dmsSuffixPattern = regexp.MustCompile(`(?i)()(-?\d+(?:\.\d+)?)\s*[°º]\s*(?:(\d+(?:\.\d+)?)\s*'\s*)?(?:(\d+(?:\.\d+)?)\s*"\s*)?([NSEWO])?`)
+	dmsPrefixed      = regexp.MustCompile(`^(?i)[NSEWO]\s*-?\d`)
+)
+
+// parseDms reads degrees, minutes and seconds such as 48°51'24"N 2°21'07"E,
+// minutes and seconds being optional and possibly decimal. Without
+// hemisphere letters, latitude comes first.
+func parseDms(s string) (latLon, error) {
+	s = strings.NewReplacer("′", "'", "’", "'", "″", `"`, "”", `"`, "''", `"`).Replace(s)
+	pattern := dmsSuffixPattern
+	if dmsPrefixed.MatchString(s) {
+		pattern = dmsPrefixPattern
+	}
+	matches := pattern.FindAllStringSubmatch(s, -1)
+	if len(matches) != 2 {
+		return latLon{}, errors.New(fmt.Sprintf("invalid location: %s", s))
+	}
+
+	var location latLon
+	seen := map[bool]bool{}
+	for i, match := range matches {
+		degrees, err := strconv.ParseFloat(match[2], 64)
+		if err != nil {
+			return latLon{}, err
+		}
+		var minutes, seconds float64
+		if match[3] != "" {
+			minutes, err = strconv.ParseFloat(match[3], 64)
+			if err != nil {
+				return latLon{}, err
+			}
+		}
+		if match[4] != "" {
+			seconds, err = strconv.ParseFloat(match[4], 64)
+			if err != nil {
+				return latLon{}, err
+			}
+		}
+		if minutes >= 60 || seconds >= 60 {
+			return latLon{}, errors.New(fmt.Sprintf("invalid location: %s", s))
+		}
+
+		value := math.Abs(degrees) + minutes/60 + seconds/3600
+		hemisphere := strings.ToUpper(match[1] + match[5])
+		if len(hemisphere) > 1 {
+			return latLon{}, errors.New(fmt.Sprintf("invalid location: %s", s))
+		}
+		if degrees < 0 || hemisphere == "S" || hemisphere == "W" || hemisphere == "O" {
+			value = -value
+		}
+
+		isLatitude := i == 0
+		if hemisphere != "" {
+			isLatitude = hemisphere == "N" || hemisphere == "S"
+		}
+		if seen[isLatitude] {
+			return latLon{}, errors.New(fmt.Sprintf("invalid location: %s", s))
+		}
+		seen[isLatitude] = true
+
+		if isLatitude {
+			location.Lat = value
+		} else {
+			location.Lon = value
+		}
+	}
+
+	return location, nil
+}
+
+const plusCodeAlphabet = "23456789CFGHJMPQRVWX"
+
+var plusCodePattern = regexp.MustCompile(`^(?i)[23456789CFGHJMPQRVWX0]{2,8}\+[23456789CFGHJMPQRVWX]*(?:\s|$)`)
+
+// plusCodePairResolutions are the sizes in degrees of the areas of the
+// first five pairs of digits of a plus code.
+var plusCodePairResolutions = []float64{20, 1, 0.05, 0.0025, 0.000125}
+
+// decodePlusCode returns the center of the area of an Open Location Code.
+// Short codes, such as "V75V+8Q", are taken as the closest match to
+// reference, and any locality after them is ignored.
+func decodePlusCode(s string, reference latLon) (latLon, error) {
+	code, _, _ := strings.Cut(strings.ToUpper(strings.TrimSpace(s)), " ")
+	separator := strings.Index(code, "+")
+	if separator < 0 || separator > 8 || separator%2 != 0 || strings.Count(code, "+") != 1 {
+		return latLon{}, errors.New(fmt.Sprintf("invalid plus code: %s", s))
+	}
+
+	if separator < 8 {
+		return recoverPlusCode(code, reference)
+	}
+
+	digits := strings.Replace(code, "+", "", 1)
+	if padding := strings.Index(digits, "0"); padding >= 0 {
+		if strings.Trim(digits[padding:], "0") != "" || padding%2 != 0 || padding == 0 {
+			return latLon{}, errors.New(fmt.Sprintf("invalid plus code: %s", s))
+		}
+		digits = digits[:padding]
+	}
+	if len(digits) == 9 {
+		// a single digit after the separator is not a valid code
+		return latLon{}, errors.New(fmt.Sprintf("invalid plus code: %s", s))
+	}
+
+	lat, lon := -90.0, -180.0
+	latResolution, lonResolution := 0.0, 0.0
+	for i, c := range digits {
+		value := strings.IndexRune(plusCodeAlphabet, c)
+		if value < 0 {
+			return latLon{}, errors.New(fmt.Sprintf("invalid plus code: %s", s))
+		}
+
+		switch {
+		case i < 10 && i%2 == 0:
+			latResolution = plusCodePairResolutions[i/2]
+			lat += float64(value) * latResolution
+		case i < 10:
+			lonResolution = plusCodePairResolutions[i/2]
+			lon += float64(value) * lonResolution
+		default:
+			// past ten digits, each one splits the area in a 4x5 grid
+			latResolution /= 5
+			lonResolution /= 4
+			lat += float64(value/4) * latResolution
+			lon += float64(value%4) * lonResolution
+		}
+	}
+
+	return latLon{Lat: lat + latResolution/2, Lon: lon + lonResolution/2}, nil
+}
+
+// recoverPlusCode completes a short code with the leading digits of the
+// reference, then moves it by one area when that gets it closer.
+func recoverPlusCode(code string, reference latLon) (latLon, error) {
+	missing := 8 - strings.Index(code, "+")
+	resolution := math.Pow(20, 2-float64(missing/2))
+
+	location, err := decodePlusCode(encodePlusCode(reference)[:missing]+code, reference)
+	if err != nil {
+		return latLon{}, err
+	}
+
+	if reference.Lat+resolution/2 < location.Lat && location.Lat-resolution >= -90 {
+		location.Lat -= resolution
+	} else if reference.Lat-resolution/2 > location.Lat && location.Lat+resolution <= 90 {
+		location.Lat += resolution
+	}
+	if reference.Lon+resolution/2 < location.Lon {
+		location.Lon -= resolution
+	} else if reference.Lon-resolution/2 > location.Lon {
+		location.Lon += resolution
+	}
+
+	return location, nil
+}
+
+// encodePlusCode returns the first ten digits of the code of a location.
+func encodePlusCode(location latLon) string {
+	lat := math.Min(location.Lat+90, 180-plusCodePairResolutions[4]/2)
+	lon := location.Lon + 180
+
+	var code strings.Builder
+	for _, resolution := range plusCodePairResolutions {
+		latDigit := int(lat / resolution)
+		lonDigit := int(lon / resolution)
+		lat -= float64(latDigit) * resolution
+		lon -= float64(lonDigit) * resolution
+		code.WriteByte(plusCodeAlphabet[latDigit])
+		code.WriteByte(plusCodeAlphabet[lonDigit])
+	}
+	return code.String()
+}
+
+const (
+	geohashAlphabet  = "0123456789bcdefghjkmnpqrstuvwxyz"
+	minGeohashLength = 5
+	// meters around Paris an unprefixed geohash must land within
+	geohashServiceRadius = 40000
+)
+
+var geohashPattern = regexp.MustCompile(`^(?i)(?:geohash:)?[0-9bcdefghjkmnpqrstuvwxyz]+$`)
+
+// isGeohash tells whether a text is a geohash. Unless prefixed with
+// "geohash:", it needs minGeohashLength characters, digits and letters, and
+// to land within geohashServiceRadius of Paris, so that house numbers such
+// as "12e" and other short tokens are left to the geocoder.
+func isGeohash(s string) bool {
+	if !geohashPattern.MatchString(s) {
+		return false
+	}
+	if strings.HasPrefix(strings.ToLower(s), "geohash:") {
+		return true
+	}
+	if len(s) < minGeohashLength || !strings.ContainsAny(s, "0123456789") || strings.IndexFunc(s, unicode.IsLetter) < 0 {
+		return false
+	}
+
+	location, err := decodeGeohash(s)
+	return err == nil && Haversine(parisCenter.Lat, parisCenter.Lon, location.Lat, location.Lon) <= geohashServiceRadius
+}
+
+// decodeGeohash returns the center of the cell of a geohash.
+func decodeGeohash(s string) (latLon, error) {
+	hash := strings.ToLower(s)
+	hash = strings.TrimPrefix(hash, "geohash:")
+	if len(hash) < 4 || len(hash) > 12 {
+		return latLon{}, errors.New(fmt.Sprintf("invalid geohash: %s", s))
+	}
+
+	latRange := [2]float64{-90, 90}
+	lonRange := [2]float64{-180, 180}
+	even := true
+	for _, c := range hash {
+		value := strings.IndexRune(geohashAlphabet, c)
+		if value < 0 {
+			return latLon{}, errors.New(fmt.Sprintf("invalid geohash: %s", s))
+		}
+
+		// bits alternate between longitude and latitude, starting with
+		// longitude
+		for bit := 4; bit >= 0; bit-- {
+			r := &latRange
+			if even {
+				r = &lonRange
+			}
+			mid := (r[0] + r[1]) / 2
+			if value&(1<<bit) != 0 {
+				r[0] = mid
+			} else {
+				r[1] = mid
+			}
+			even = !even
+		}
+	}
+
+	return latLon{Lat: (latRange[0] + latRange[1]) / 2, Lon: (lonRange[0] + lonRange[1]) / 2}, nil
+}
+
+// Lambert-93 is the Lambert conformal conic projection of RGF93 on the
+// GRS80 ellipsoid. RGF93 and WGS84 differ by less than a meter.
+const (
+	lambert93N  = 0.7256077650532670
+	lambert93C  = 11754255.426096
+	lambert93Xs = 700000
+	lambert93Ys = 12655612.049876
+	// central meridian, in degrees
+	lambert93Lon0 = 3
+	// first eccentricity of GRS80
+	grs80E = 0.0818191910428158
+)
+
+func lambert93ToWgs84(x, y float64) latLon {
+	dx := x - lambert93Xs
+	dy := lambert93Ys - y
+	r := math.Hypot(dx, dy)
+	gamma := math.Atan(dx / dy)
+
+	lon := lambert93Lon0 + gamma/lambert93N*180/math.Pi
+	isometric := -math.Log(r/lambert93C) / lambert93N
+
+	lat := 2*math.Atan(math.Exp(isometric)) - math.Pi/2
+	for range 10 {
+		sin := grs80E * math.Sin(lat)
+		next := 2*math.Atan(math.Pow((1+sin)/(1-sin), grs80E/2)*math.Exp(isometric)) - math.Pi/2
+		if math.Abs(next-lat) < 1e-12 {
+			lat = next
+			break
+		}
+		lat = next
+	}
+
+	return latLon{Lat: lat * 180 / math.Pi, Lon: lon}
+}
+
+var (
+	// Google Maps places, more precise than the map center
+	googlePlacePattern = regexp.MustCompile(`!3d(-?\d+(?:\.\d+)?)!4d(-?\d+(?:\.\d+)?)`)
+	// Google Maps map centers, as in /@48.85,2.35,15z
+	googleCenterPattern = regexp.MustCompile(`@(-?\d+(?:\.\d+)?),(-?\d+(?:\.\d+)?)`)
+	// OpenStreetMap map centers, as in #map=15/48.85/2.35
+	osmCenterPattern = regexp.MustCompile(`map=\d+(?:\.\d+)?/(-?\d+(?:\.\d+)?)/(-?\d+(?:\.\d+)?)`)
+)
+
+// mapUrlParams are the query parameters map sites put a location in, the
+// more precise first.
+var mapUrlParams = []string{"ll", "q", "query", "destination", "daddr", "center", "sll"}
+
+// parseMapUrl reads the location of a geo: URI or of a link to Google Maps,
+// OpenStreetMap, Apple Plans, Bing Maps or Waze.
+func parseMapUrl(s string) (latLon, error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return latLon{}, err
+	}
+
+	if strings.EqualFold(u.Scheme, "geo") {
+		// geo:48.85,2.35;u=10 or geo:0,0?q=48.85,2.35(label)
+		coordinates, _, _ := strings.Cut(u.Opaque, ";")
+		if coordinates != "0,0" || !u.Query().Has("q") {
+			return parseCoordinatePair(coordinates)
+		}
+	}
+
+	if match := googlePlacePattern.FindStringSubmatch(s); match != nil {
+		return parseCoordinatePair(match[1] + "," + match[2])
+	}
+
+	query := u.Query()
+	if query.Has("mlat") && query.Has("mlon") {
+		return parseCoordinatePair(query.Get("mlat") + "," + query.Get("mlon"))
+	}
+	for _, name := range mapUrlParams {
+		value := query.Get(name)
+		// labels, as in 48.85,2.35(Home), are not part of the location
+		value, _, _ = strings.Cut(value, "(")
+		if value == "" {
+			continue
+		}
+		location, err := parseLocation(value)
+		if err == nil {
+			return location, nil
+		}
+	}
+	if cp := query.Get("cp"); cp != "" {
+		return parseCoordinatePair(strings.Replace(cp, "~", ",", 1))
+	}
+
+	if match := googleCenterPattern.FindStringSubmatch(u.Path); match != nil {
+		return parseCoordinatePair(match[1] + "," + match[2])
+	}
+	if match := osmCenterPattern.FindStringSubmatch(u.Fragment); match != nil {
+		return parseCoordinatePair(match[1] + "," + match[2])
+	}
+
+	if u.Host == "goo.gl" || u.Host == "maps.app.goo.gl" {
+		return latLon{}, errors.New("short map links cannot be resolved offline, paste the full link")
+	}
+	return latLon{}, errors.New(fmt.Sprintf("no location found in link: %s", s))
+}
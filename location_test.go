@@ -0,0 +1,186 @@
+package main
+
+import (
+	"math"
+	"net/url"
+	"testing"
+)
+
+// closeTo tells whether two locations are within tolerance degrees.
+func closeTo(a, b latLon, tolerance float64) bool {
+	return math.Abs(a.Lat-b.Lat) <= tolerance && math.Abs(a.Lon-b.Lon) <= tolerance
+}
+
+func TestParseLocation(t *testing.T) {
+	tests := []struct {
+		name      string
+		input     string
+		want      latLon
+		tolerance float64
+	}{
+		{"decimal degrees", "48.8566,2.3522", latLon{48.8566, 2.3522}, 1e-9},
+		{"decimal degrees with space", "48.8566 2.3522", latLon{48.8566, 2.3522}, 1e-9},
+		{"decimal degrees southern and western", "-33.8568, -151.2153", latLon{-33.8568, -151.2153}, 1e-9},
+
+		// the Eiffel Tower, 48.85830, 2.29450
+		{"plus code", "8FW4V75V+8Q", latLon{48.85830, 2.29450}, 1e-4},
+		{"short plus code", "V75V+8Q", latLon{48.85830, 2.29450}, 1e-4},
+		{"short plus code with locality", "V75V+8Q Paris", latLon{48.85830, 2.29450}, 1e-4},
+		{"padded plus code", "8FW40000+", latLon{48.5, 2.5}, 1e-9},
+
+		// the reference example of the geohash article, 42.605, -5.603
+		{"geohash", "u09tunq", latLon{48.8583, 2.2945}, 1e-3},
+		{"prefixed geohash", "geohash:ezs42", latLon{42.605, -5.603}, 1e-3},
+
+		{"dms with suffixes", `48°51'24"N 2°21'07"E`, latLon{48.856667, 2.351944}, 1e-6},
+		{"dms with prefixes", `N 48°51'24" E 2°21'07"`, latLon{48.856667, 2.351944}, 1e-6},
+		{"dms longitude first", `2°21'07"E 48°51'24"N`, latLon{48.856667, 2.351944}, 1e-6},
+		{"dms ouest", `48°51'24"N 1°30'O`, latLon{48.856667, -1.5}, 1e-6},
+		{"dms typographic quotes", "48°51′24″N 2°21′07″E", latLon{48.856667, 2.351944}, 1e-6},
+		{"dms decimal minutes", "48°51.4'N 2°21.1167'E", latLon{48.856667, 2.351944}, 1e-4},
+		{"dms degrees only", "48.8566°N 2.3522°E", latLon{48.8566, 2.3522}, 1e-9},
+
+		// the origin of the projection is 46.5°N 3°E
+		{"lambert-93 origin", "700000,6600000", latLon{46.5, 3}, 1e-9},
+		{"lambert-93 prefixed", "EPSG:2154 700000 6600000", latLon{46.5, 3}, 1e-9},
+
+		{"google place", "https://www.google.com/maps/place/Tour+Eiffel/@48.85,2.35,15z/data=!3d48.8584!4d2.2945", latLon{48.8584, 2.2945}, 1e-9},
+		{"google center", "https://www.google.com/maps/@48.8566,2.3522,15z", latLon{48.8566, 2.3522}, 1e-9},
+		{"google query", "https://maps.google.com/?q=48.8566,2.3522", latLon{48.8566, 2.3522}, 1e-9},
+		{"openstreetmap marker", "https://www.openstreetmap.org/?mlat=48.8566&mlon=2.3522#map=15/48.8/2.3", latLon{48.8566, 2.3522}, 1e-9},
+		{"openstreetmap center", "https://www.openstreetmap.org/#map=15/48.8566/2.3522", latLon{48.8566, 2.3522}, 1e-9},
+		{"apple plans", "https://maps.apple.com/?ll=48.8566,2.3522&q=Home", latLon{48.8566, 2.3522}, 1e-9},
+		{"bing", "https://www.bing.com/maps?cp=48.8566~2.3522&lvl=15", latLon{48.8566, 2.3522}, 1e-9},
+		{"geo uri", "geo:48.8566,2.3522;u=10", latLon{48.8566, 2.3522}, 1e-9},
+		{"geo uri with query", "geo:0,0?q=48.8566,2.3522(Home)", latLon{48.8566, 2.3522}, 1e-9},
+	}
+
+	for _, test := range tests {
+		got, err := parseLocation(test.input)
+		if err != nil {
+			t.Errorf("%s: parseLocation(%q) failed: %v", test.name, test.input, err)
+			continue
+		}
+		if !closeTo(got, test.want, test.tolerance) {
+			t.Errorf("%s: parseLocation(%q) = %v, want %v", test.name, test.input, got, test.want)
+		}
+	}
+}
+
+func TestParseLocationInvalid(t *testing.T) {
+	tests := []string{
+		"",
+		"NaN,NaN",
+		"NaN,2.35",
+		"Inf,Inf",
+		"+Inf,-Inf",
+		"48.85",
+		"48.85,2.35,3",
+		// out of range, or longitude first
+		"91,2.35",
+		"48.85,181",
+		"120.5,45.2",
+		"2.3522,-200",
+		// out of range in the Lambert-93 magnitudes
+		"700000,5000000",
+		`48°61'N 2°E`,
+		`48°51'61"N 2°E`,
+		`48°N 2°N`,
+		`48°N`,
+		"8FW4V75V+8",
+		"8FW4V+8Q",
+		"8FW40+",
+		"geohash:ab",
+		// geohashes far from Paris need the prefix, short tokens go to the
+		// geocoder, which is not loaded here
+		"ezs42",
+		"12e",
+		"75b",
+		"u09t",
+		"geohash:u09tunqu09tunq",
+		"https://maps.app.goo.gl/abcdef",
+		"https://example.com/nothing",
+		"rue de nulle part",
+	}
+
+	for _, input := range tests {
+		got, err := parseLocation(input)
+		if err == nil {
+			t.Errorf("parseLocation(%q) = %v, want an error", input, got)
+		}
+	}
+}
+
+// wgs84ToLambert93 is the forward projection, for round trips.
+func wgs84ToLambert93(location latLon) (float64, float64) {
+	lat := location.Lat * math.Pi / 180
+	sin := grs80E * math.Sin(lat)
+	isometric := math.Log(math.Tan(math.Pi/4+lat/2)) - grs80E/2*math.Log((1+sin)/(1-sin))
+	r := lambert93C * math.Exp(-lambert93N*isometric)
+	gamma := lambert93N * (location.Lon - lambert93Lon0) * math.Pi / 180
+	return lambert93Xs + r*math.Sin(gamma), lambert93Ys - r*math.Cos(gamma)
+}
+
+func TestLambert93RoundTrip(t *testing.T) {
+	for _, location := range []latLon{{48.8566, 2.3522}, {48.8583, 2.2945}, {43.2965, 5.3698}, {51.0, -4.5}, {41.5, 9.2}} {
+		x, y := wgs84ToLambert93(location)
+		got := lambert93ToWgs84(x, y)
+		if !closeTo(got, location, 1e-9) {
+			t.Errorf("lambert93ToWgs84(%f, %f) = %v, want %v", x, y, got, location)
+		}
+	}
+}
+
+func TestPlusCodeEncodingAndRecovery(t *testing.T) {
+	if got := encodePlusCode(latLon{48.85830, 2.29450}); got[:8] != "8FW4V75V" {
+		t.Errorf("encodePlusCode = %s, want 8FW4V75V…", got)
+	}
+
+	// short codes are recovered next to the reference, even across the
+	// edge of the area they share digits with
+	got, err := decodePlusCode("2222+22", latLon{Lat: 48.99999, Lon: 2.99999})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !closeTo(got, latLon{49.0000625, 3.0000625}, 1e-9) {
+		t.Errorf("decodePlusCode(2222+22) near 49, 3 = %v", got)
+	}
+}
+
+func TestParseLocationParams(t *testing.T) {
+	valid := []struct {
+		query string
+		want  latLon
+	}{
+		{"latitude=48.8566&longitude=2.3522", latLon{48.8566, 2.3522}},
+		{"location=48.8566,2.3522", latLon{48.8566, 2.3522}},
+		{"location=8FW4V75V%2B8Q", latLon{48.85830, 2.29450}},
+	}
+	for _, test := range valid {
+		params, _ := url.ParseQuery(test.query)
+		got, err := parseLocationParams(params)
+		if err != nil || !closeTo(got, test.want, 1e-4) {
+			t.Errorf("parseLocationParams(%s) = %v, %v, want %v", test.query, got, err, test.want)
+		}
+	}
+
+	invalid := []string{
+		"",
+		"latitude=48.8566",
+		"latitude=NaN&longitude=2.3522",
+		"latitude=48.8566&longitude=NaN",
+		"latitude=Inf&longitude=2.3522",
+		"latitude=48.8566&longitude=-Inf",
+		"latitude=2.3522&longitude=248.8566",
+		"latitude=-91&longitude=0",
+		"latitude=abc&longitude=2",
+		"location=NaN,NaN",
+	}
+	for _, query := range invalid {
+		params, _ := url.ParseQuery(query)
+		got, err := parseLocationParams(params)
+		if err == nil {
+			t.Errorf("parseLocationParams(%s) = %v, want an error", query, got)
+		}
+	}
+}
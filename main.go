@@ -3,11 +3,11 @@ package main
 import (
 	"context"
 	"database/sql"
-	"encoding/json"
 	"errors"
 	"fmt"
 	"log"
 	"net/http"
+	"strconv"
 	"strings"
 	"time"
 
@@ -20,8 +20,19 @@ func handleHttpError(w http.ResponseWriter, err error) {
 	log.Print(err)
 }
 
+func handleHttpBadRequest(w http.ResponseWriter, err error) {
+	http.Error(w, err.Error(), http.StatusBadRequest)
+}
+
 var db *sql.DB
 
+const (
+	refreshInterval = time.Minute
+	// stations missing from the feed this long are deleted, and published as
+	// retired, a late or partial fetch being given a few refreshes to recover
+	staleStationDelay = 5 * refreshInterval
+)
+
 func refreshStations() error {
 	var data struct {
 		Data struct {
@@ -30,49 +41,75 @@ func refreshStations() error {
 	}
 
 	// station information
-	r, err := http.Get("https://velib-metropole-opendata.smovengo.cloud/opendata/Velib_Metropole/station_information.json")
+	err := fetchGbfsFeed("station_information", &data)
 	if err != nil {
 		return err
 	}
-	defer r.Body.Close()
 
-	dec := json.NewDecoder(r.Body)
-	err = dec.Decode(&data)
+	// station status
+	err = fetchGbfsFeed("station_status", &data)
 	if err != nil {
 		return err
 	}
 
-	// station status
-	r, err = http.Get("https://velib-metropole-opendata.smovengo.cloud/opendata/Velib_Metropole/station_status.json")
-	if err != nil {
-		return err
+	for i, station := range data.Data.Stations {
+		for _, types := range station.BikeTypes {
+			data.Data.Stations[i].EBikeCount += types["ebike"]
+		}
 	}
-	defer r.Body.Close()
 
-	dec = json.NewDecoder(r.Body)
-	err = dec.Decode(&data)
+	tx, err := db.BeginTx(context.Background(), &sql.TxOptions{Isolation: sql.LevelSerializable})
 	if err != nil {
 		return err
 	}
 
-	tx, err := db.BeginTx(context.Background(), &sql.TxOptions{Isolation: sql.LevelSerializable})
+	previous, err := currentStations(tx)
+	if err != nil {
+		return errors.Join(err, tx.Rollback())
+	}
 
-	insertQuery := "INSERT INTO stations (station_id, name, lat, lon, bike_count, dock_count, updated_at) VALUES "
+	insertQuery := "INSERT INTO stations (station_id, name, lat, lon, capacity, bike_count, ebike_count, dock_count, region_id, updated_at) VALUES "
 	for _, station := range data.Data.Stations {
-		insertQuery += fmt.Sprintf("(%d, '%s', %f, %f, %d, %d, NOW()),", station.StationId, strings.Replace(station.Name, "'", "''", -1), station.Lat, station.Lon, station.BikeCount, station.DockCount)
+		insertQuery += fmt.Sprintf("(%d, '%s', %s, %s, %d, %d, %d, %d, '%s', NOW()),", station.StationId, strings.Replace(station.Name, "'", "''", -1), strconv.FormatFloat(station.Lat, 'f', -1, 64), strconv.FormatFloat(station.Lon, 'f', -1, 64), station.Capacity, station.BikeCount, station.EBikeCount, station.DockCount, strings.Replace(string(station.RegionId), "'", "''", -1))
 	}
-	insertQuery = strings.TrimRight(insertQuery, ",") + " ON CONFLICT (station_id) DO UPDATE SET bike_count = EXCLUDED.bike_count, dock_count = EXCLUDED.dock_count, updated_at = EXCLUDED.updated_at"
+	insertQuery = strings.TrimRight(insertQuery, ",") + " ON CONFLICT (station_id) DO UPDATE SET name = EXCLUDED.name, lat = EXCLUDED.lat, lon = EXCLUDED.lon, capacity = EXCLUDED.capacity, region_id = EXCLUDED.region_id, bike_count = EXCLUDED.bike_count, ebike_count = EXCLUDED.ebike_count, dock_count = EXCLUDED.dock_count, updated_at = EXCLUDED.updated_at"
 	_, err = tx.Exec(insertQuery)
 	if err != nil {
 		return errors.Join(err, tx.Rollback())
 	}
 
-	_, err = tx.Exec("DELETE FROM stations WHERE updated_at - NOW() > INTERVAL '1 minute'")
+	_, err = tx.Exec("DELETE FROM stations WHERE updated_at < $1", time.Now().Add(-staleStationDelay))
 	if err != nil {
 		return errors.Join(err, tx.Rollback())
 	}
 
-	return tx.Commit()
+	err = recordChanges(tx, previous, data.Data.Stations)
+	if err != nil {
+		return errors.Join(err, tx.Rollback())
+	}
+
+	err = recordHistory(tx)
+	if err != nil {
+		return errors.Join(err, tx.Rollback())
+	}
+
+	err = recordStationAreas(tx, data.Data.Stations)
+	if err != nil {
+		return errors.Join(err, tx.Rollback())
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+
+	stationTiles.Invalidate()
+	snapshot, err := publishStations()
+	if err != nil {
+		return err
+	}
+
+	return evaluateWatches(snapshot)
 }
 
 func main() {
@@ -82,8 +119,52 @@ func main() {
 		panic(err)
 	}
 
+	err = loadNetworkLocation()
+	if err != nil {
+		panic(err)
+	}
+
+	_, err = publishStations()
+	if err != nil {
+		log.Print(err)
+	}
+
+	err = loadVapidKey()
+	if err != nil {
+		panic(err)
+	}
+
+	err = loadRankingWeights()
+	if err != nil {
+		panic(err)
+	}
+
+	err = loadGeoIpDatabase()
+	if err != nil {
+		panic(err)
+	}
+
+	err = loadTrustedProxies()
+	if err != nil {
+		panic(err)
+	}
+
+	err = loadAreas()
+	if err != nil {
+		panic(err)
+	}
+
+	go deliverWatchEvents()
+	go pruneHistoryPeriodically()
+	go computeReliabilityPeriodically()
+	go computeStationFlowsPeriodically()
+	go loadWalkingGraph()
+	go refreshPricingPlansPeriodically()
+	go refreshAlertsPeriodically()
+	go loadAddressGeocoder()
+
 	// update data periodically
-	ticker := time.NewTicker(time.Minute)
+	ticker := time.NewTicker(refreshInterval)
 	defer ticker.Stop()
 	go func() {
 		for {
@@ -98,12 +179,47 @@ func main() {
 	}()
 
 	stationsController := StationsController{}
+	stationPageController := StationPageController{}
 	indexController := IndexController{}
 	filesController := FilesController{}
+	tilesController := TilesController{}
+	streamController := StreamController{}
+	subscriptionsController := SubscriptionsController{}
+	watchesController := WatchesController{}
+	pushController := PushController{}
+	analyticsController := AnalyticsController{}
+	tripsController := TripsController{}
+	pricingController := PricingController{}
+	alertsController := AlertsController{}
+	geocodeController := GeocodeController{}
+	areasController := AreasController{}
 
 	http.HandleFunc("GET /{$}", indexController.Show)
 	http.HandleFunc("GET /stations/closest", stationsController.ListClosest)
+	http.HandleFunc("GET /stations/{station_id}", stationPageController.Show)
+	http.HandleFunc("GET /api/v1/stations", stationsController.ListInBBox)
+	http.HandleFunc("GET /api/v1/stations/{station_id}", stationsController.Show)
+	http.HandleFunc("GET /api/v1/stations/{station_id}/reliability", stationsController.ShowReliability)
+	http.HandleFunc("GET /api/v1/stations/changes", stationsController.ListChanges)
+	http.HandleFunc("GET /api/v1/stations/search", stationsController.Search)
+	http.HandleFunc("GET /api/v1/stations/closest", stationsController.ListClosestDetails)
+	http.HandleFunc("GET /api/v1/stations/stream", streamController.Stream)
+	http.HandleFunc("GET /api/v1/stations/subscribe", subscriptionsController.Connect)
+	http.HandleFunc("POST /api/v1/watches", watchesController.Create)
+	http.HandleFunc("GET /api/v1/watches/{id}", watchesController.Show)
+	http.HandleFunc("DELETE /api/v1/watches/{id}", watchesController.Delete)
+	http.HandleFunc("GET /api/v1/push/vapid-public-key", pushController.ShowVapidKey)
+	http.HandleFunc("GET /api/v1/analytics/station-flows", analyticsController.ListStationFlows)
+	http.HandleFunc("GET /api/v1/analytics/flows", analyticsController.ListFlows)
+	http.HandleFunc("GET /api/v1/trips", tripsController.Plan)
+	http.HandleFunc("GET /api/v1/pricing-plans", pricingController.List)
+	http.HandleFunc("GET /api/v1/alerts", alertsController.List)
+	http.HandleFunc("GET /api/v1/geocode", geocodeController.Search)
+	http.HandleFunc("GET /api/v1/geocode/reverse", geocodeController.Reverse)
+	http.HandleFunc("GET /api/v1/areas", areasController.List)
+	http.HandleFunc("GET /api/v1/areas/history", areasController.ListHistory)
 	http.HandleFunc("GET /files/{name}", filesController.Show)
+	http.HandleFunc("GET /tiles/stations/{z}/{x}/{y}", tilesController.ShowStations)
 
 	err = http.ListenAndServe(":8080", nil)
 	if err != nil {
@@ -0,0 +1,26 @@
+package main
+
+import "math"
+
+const tileSize = 256
+
+// mercatorPixel projects a coordinate to Web Mercator pixel coordinates at
+// the given zoom, with the world being tileSize << zoom pixels wide.
+func mercatorPixel(lat, lon float64, zoom int) (float64, float64) {
+	scale := float64(tileSize) * math.Exp2(float64(zoom))
+	sin := math.Sin(lat * math.Pi / 180)
+	x := (lon + 180) / 360 * scale
+	y := (0.5 - math.Log((1+sin)/(1-sin))/(4*math.Pi)) * scale
+
+	return x, y
+}
+
+// mercatorLatLon is the inverse of mercatorPixel.
+func mercatorLatLon(x, y float64, zoom int) (float64, float64) {
+	scale := float64(tileSize) * math.Exp2(float64(zoom))
+	lon := x/scale*360 - 180
+	n := math.Pi - 2*math.Pi*y/scale
+	lat := 180 / math.Pi * math.Atan(math.Sinh(n))
+
+	return lat, lon
+}
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+	"net/netip"
+	"os"
+)
+
+// mmdbReader reads MaxMind DB files, such as GeoLite2-City.mmdb: a binary
+// search tree over the bits of IP addresses whose leaves point into a data
+// section of typed values.
+type mmdbReader struct {
+	buf        []byte
+	nodeCount  uint64
+	recordSize uint64
+	ipVersion  uint64
+	// start of the data section in buf
+	dataStart uint64
+	// node reached after the 96 zero bits IPv4 addresses start with in an
+	// IPv6 tree
+	ipv4Start uint64
+}
+
+var mmdbMetadataMarker = []byte("\xab\xcd\xefMaxMind.com")
+
+const (
+	// the metadata is within this many bytes of the end of the file
+	mmdbMetadataMaxSize = 128 * 1024
+	// zero bytes between the search tree and the data section
+	mmdbDataSeparator = 16
+)
+
+func openMmdb(path string) (*mmdbReader, error) {
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	search := buf[max(0, len(buf)-mmdbMetadataMaxSize):]
+	marker := bytes.LastIndex(search, mmdbMetadataMarker)
+	if marker < 0 {
+		return nil, errors.New(fmt.Sprintf("%s: not a MaxMind DB file", path))
+	}
+	metadataStart := len(buf) - len(search) + marker + len(mmdbMetadataMarker)
+
+	metadata := &mmdbReader{buf: buf[metadataStart:]}
+	value, _, err := metadata.decode(0)
+	if err != nil {
+		return nil, err
+	}
+	fields, ok := value.(map[string]any)
+	if !ok {
+		return nil, errors.New(fmt.Sprintf("%s: invalid metadata", path))
+	}
+
+	r := &mmdbReader{buf: buf[:len(buf)-len(search)+marker]}
+	r.nodeCount, _ = fields["node_count"].(uint64)
+	r.recordSize, _ = fields["record_size"].(uint64)
+	r.ipVersion, _ = fields["ip_version"].(uint64)
+	if r.recordSize != 24 && r.recordSize != 28 && r.recordSize != 32 {
+		return nil, errors.New(fmt.Sprintf("%s: unsupported record size %d", path, r.recordSize))
+	}
+	r.dataStart = r.nodeCount*r.recordSize/4 + mmdbDataSeparator
+	if r.dataStart > uint64(len(r.buf)) {
+		return nil, errors.New(fmt.Sprintf("%s: truncated search tree", path))
+	}
+
+	if r.ipVersion == 6 {
+		for i := 0; i < 96 && r.ipv4Start < r.nodeCount; i++ {
+			r.ipv4Start = r.record(r.ipv4Start, 0)
+		}
+	}
+
+	return r, nil
+}
+
+// record returns the left (bit 0) or right (bit 1) record of a node.
+func (r *mmdbReader) record(node uint64, bit byte) uint64 {
+	b := r.buf[node*r.recordSize/4:]
+	switch r.recordSize {
+	case 24:
+		b = b[uint64(bit)*3:]
+		return uint64(b[0])<<16 | uint64(b[1])<<8 | uint64(b[2])
+	case 28:
+		if bit == 0 {
+			return uint64(b[3]&0xf0)<<20 | uint64(b[0])<<16 | uint64(b[1])<<8 | uint64(b[2])
+		}
+		return uint64(b[3]&0x0f)<<24 | uint64(b[4])<<16 | uint64(b[5])<<8 | uint64(b[6])
+	default:
+		return uint64(binary.BigEndian.Uint32(b[uint64(bit)*4:]))
+	}
+}
+
+// Lookup returns the data of the network an address belongs to, or nil when
+// the database has none.
+func (r *mmdbReader) Lookup(addr netip.Addr) (any, error) {
+	addr = addr.Unmap()
+	node := uint64(0)
+	bits := addr.AsSlice()
+	if addr.Is4() && r.ipVersion == 6 {
+		node = r.ipv4Start
+	} else if addr.Is6() && r.ipVersion == 4 {
+		return nil, nil
+	}
+
+	for i := 0; i < len(bits)*8 && node < r.nodeCount; i++ {
+		bit := bits[i/8] >> (7 - i%8) & 1
+		node = r.record(node, bit)
+	}
+
+	if node == r.nodeCount {
+		return nil, nil
+	}
+	if node < r.nodeCount {
+		return nil, errors.New("invalid MaxMind DB search tree")
+	}
+
+	data := &mmdbReader{buf: r.buf[r.dataStart:]}
+	value, _, err := data.decode(node - r.nodeCount - mmdbDataSeparator)
+	return value, err
+}
+
+// decode decodes the value at offset of buf, buf being the data section,
+// and returns it along with the offset following it.
+func (r *mmdbReader) decode(offset uint64) (any, uint64, error) {
+	next := func(n uint64) ([]byte, error) {
+		if offset+n > uint64(len(r.buf)) {
+			return nil, errors.New("truncated MaxMind DB data")
+		}
+		b := r.buf[offset : offset+n]
+		offset += n
+		return b, nil
+	}
+
+	b, err := next(1)
+	if err != nil {
+		return nil, offset, err
+	}
+	control := b[0]
+	kind := control >> 5
+	if kind == 1 {
+		return r.decodePointer(control, offset)
+	}
+	if kind == 0 {
+		b, err := next(1)
+		if err != nil {
+			return nil, offset, err
+		}
+		kind = 7 + b[0]
+	}
+
+	size := uint64(control & 0x1f)
+	if size >= 29 {
+		extra := size - 28
+		b, err := next(extra)
+		if err != nil {
+			return nil, offset, err
+		}
+		n := uint64(0)
+		for _, c := range b {
+			n = n<<8 | uint64(c)
+		}
+		size = []uint64{29, 285, 65821}[extra-1] + n
+	}
+
+	switch kind {
+	case 2:
+		b, err := next(size)
+		return string(b), offset, err
+	case 3:
+		b, err := next(8)
+		if err != nil {
+			return nil, offset, err
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(b)), offset, nil
+	case 4:
+		b, err := next(size)
+		return bytes.Clone(b), offset, err
+	case 5, 6, 9:
+		b, err := next(size)
+		if err != nil {
+			return nil, offset, err
+		}
+		n := uint64(0)
+		for _, c := range b {
+			n = n<<8 | uint64(c)
+		}
+		return n, offset, nil
+	case 8:
+		b, err := next(size)
+		if err != nil {
+			return nil, offset, err
+		}
+		n := uint32(0)
+		for _, c := range b {
+			n = n<<8 | uint32(c)
+		}
+		return int64(int32(n)), offset, nil
+	case 10:
+		b, err := next(size)
+		return new(big.Int).SetBytes(b), offset, err
+	case 7:
+		m := make(map[string]any, size)
+		for range size {
+			key, after, err := r.decode(offset)
+			if err != nil {
+				return nil, offset, err
+			}
+			name, ok := key.(string)
+			if !ok {
+				return nil, offset, errors.New("invalid MaxMind DB map key")
+			}
+			value, after, err := r.decode(after)
+			if err != nil {
+				return nil, offset, err
+			}
+			m[name] = value
+			offset = after
+		}
+		return m, offset, nil
+	case 11:
+		a := make([]any, 0, size)
+		for range size {
+			value, after, err := r.decode(offset)
+			if err != nil {
+				return nil, offset, err
+			}
+			a = append(a, value)
+			offset = after
+		}
+		return a, offset, nil
+	case 14:
+		return size != 0, offset, nil
+	case 15:
+		b, err := next(4)
+		if err != nil {
+			return nil, offset, err
+		}
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(b))), offset, nil
+	}
+	return nil, offset, errors.New(fmt.Sprintf("unsupported MaxMind DB data type %d", kind))
+}
+
+// decodePointer decodes the value a pointer points to, returning the
+// offset following the pointer itself.
+func (r *mmdbReader) decodePointer(control byte, offset uint64) (any, uint64, error) {
+	size := uint64(control>>3&0x3) + 1
+	if offset+size > uint64(len(r.buf)) {
+		return nil, offset, errors.New("truncated MaxMind DB data")
+	}
+
+	b := r.buf[offset : offset+size]
+	target := uint64(0)
+	if size < 4 {
+		target = uint64(control & 0x7)
+	}
+	for _, c := range b {
+		target = target<<8 | uint64(c)
+	}
+	target += []uint64{0, 2048, 526336, 0}[size-1]
+
+	value, _, err := r.decode(target)
+	return value, offset + size, err
+}
@@ -0,0 +1,408 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"math/big"
+	"net/http/httptest"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// mmdbValue encodes a control byte, with its extended type and size bytes,
+// followed by payload.
+func mmdbValue(kind byte, size int, payload ...byte) []byte {
+	var control []byte
+	switch {
+	case size < 29:
+		control = []byte{byte(size)}
+	case size < 285:
+		control = []byte{29, byte(size - 29)}
+	case size < 65821:
+		control = []byte{30, byte((size - 285) >> 8), byte(size - 285)}
+	default:
+		control = []byte{31, byte((size - 65821) >> 16), byte((size - 65821) >> 8), byte(size - 65821)}
+	}
+
+	if kind <= 7 {
+		control[0] |= kind << 5
+	} else {
+		control = append([]byte{control[0]}, append([]byte{kind - 7}, control[1:]...)...)
+	}
+	return append(control, payload...)
+}
+
+func mmdbString(s string) []byte {
+	return mmdbValue(2, len(s), []byte(s)...)
+}
+
+func mmdbDouble(f float64) []byte {
+	return mmdbValue(3, 8, binary.BigEndian.AppendUint64(nil, math.Float64bits(f))...)
+}
+
+func mmdbUint16(n uint16) []byte {
+	return mmdbValue(5, 2, byte(n>>8), byte(n))
+}
+
+// mmdbMap encodes a map of keys and already encoded values, in order.
+func mmdbMap(pairs ...any) []byte {
+	b := mmdbValue(7, len(pairs)/2)
+	for i := 0; i < len(pairs); i += 2 {
+		b = append(b, mmdbString(pairs[i].(string))...)
+		b = append(b, pairs[i+1].([]byte)...)
+	}
+	return b
+}
+
+// mmdbPointer encodes a pointer to offset with the smallest size able to
+// hold it, or with 4 bytes when long is set.
+func mmdbPointer(offset int, long bool) []byte {
+	switch {
+	case long:
+		return binary.BigEndian.AppendUint32([]byte{1<<5 | 3<<3}, uint32(offset))
+	case offset < 2048:
+		return []byte{1<<5 | byte(offset>>8), byte(offset)}
+	case offset < 526336:
+		offset -= 2048
+		return []byte{1<<5 | 1<<3 | byte(offset>>16), byte(offset >> 8), byte(offset)}
+	default:
+		offset -= 526336
+		return []byte{1<<5 | 2<<3 | byte(offset>>24), byte(offset >> 16), byte(offset >> 8), byte(offset)}
+	}
+}
+
+func TestMmdbDecode(t *testing.T) {
+	tests := []struct {
+		name    string
+		encoded []byte
+		want    any
+	}{
+		{"string", mmdbString("Paris"), "Paris"},
+		{"empty string", mmdbString(""), ""},
+		{"29 byte string", mmdbString(string(bytes.Repeat([]byte("a"), 29))), string(bytes.Repeat([]byte("a"), 29))},
+		{"300 byte string", mmdbString(string(bytes.Repeat([]byte("b"), 300))), string(bytes.Repeat([]byte("b"), 300))},
+		{"70000 byte string", mmdbString(string(bytes.Repeat([]byte("c"), 70000))), string(bytes.Repeat([]byte("c"), 70000))},
+		{"double", mmdbDouble(48.8566), 48.8566},
+		{"negative double", mmdbDouble(-2.3522), -2.3522},
+		{"bytes", mmdbValue(4, 3, 1, 2, 3), []byte{1, 2, 3}},
+		{"uint16", mmdbUint16(1000), uint64(1000)},
+		{"zero uint16", mmdbValue(5, 0), uint64(0)},
+		{"uint32", mmdbValue(6, 4, 0xde, 0xad, 0xbe, 0xef), uint64(0xdeadbeef)},
+		{"int32", mmdbValue(8, 4, 0xff, 0xff, 0xff, 0xfe), int64(-2)},
+		{"short int32", mmdbValue(8, 1, 0x7f), int64(127)},
+		{"uint64", mmdbValue(9, 8, 1, 0, 0, 0, 0, 0, 0, 0), uint64(1) << 56},
+		{"uint128", mmdbValue(10, 16, append([]byte{1}, make([]byte, 15)...)...), new(big.Int).Lsh(big.NewInt(1), 120)},
+		{"array", append(mmdbValue(11, 2), append(mmdbString("fr"), mmdbUint16(7)...)...), []any{"fr", uint64(7)}},
+		{"true", mmdbValue(14, 1), true},
+		{"false", mmdbValue(14, 0), false},
+		{"float", mmdbValue(15, 4, binary.BigEndian.AppendUint32(nil, math.Float32bits(1.5))...), 1.5},
+		{"map", mmdbMap("latitude", mmdbDouble(48.8566), "accuracy_radius", mmdbUint16(20)), map[string]any{"latitude": 48.8566, "accuracy_radius": uint64(20)}},
+		{"nested map", mmdbMap("names", mmdbMap("fr", mmdbString("Paris"))), map[string]any{"names": map[string]any{"fr": "Paris"}}},
+	}
+
+	for _, test := range tests {
+		// trailing bytes must be left alone
+		r := &mmdbReader{buf: append(test.encoded, 0xff)}
+		got, next, err := r.decode(0)
+		if err != nil {
+			t.Errorf("%s: decode failed: %v", test.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: decode = %#v, want %#v", test.name, got, test.want)
+		}
+		if next != uint64(len(test.encoded)) {
+			t.Errorf("%s: decode ends at %d, want %d", test.name, next, len(test.encoded))
+		}
+	}
+
+	for _, truncated := range [][]byte{mmdbString("Paris")[:3], mmdbDouble(1)[:5], mmdbMap("a", mmdbUint16(1))[:4], {}, {0}} {
+		r := &mmdbReader{buf: truncated}
+		_, _, err := r.decode(0)
+		if err == nil {
+			t.Errorf("decode of truncated %x succeeded", truncated)
+		}
+	}
+}
+
+func TestMmdbDecodePointer(t *testing.T) {
+	for _, target := range []int{16, 2047, 2048, 100000, 526335, 526336, 600000} {
+		for _, long := range []bool{false, true} {
+			pointer := mmdbPointer(target, long)
+			// the pointer, then padding up to the target, then a map
+			// holding a pointer back to a string after the pointer
+			buf := append([]byte{}, pointer...)
+			stringOffset := len(buf)
+			buf = append(buf, mmdbString("France")...)
+			buf = append(buf, make([]byte, target-len(buf))...)
+			buf = append(buf, mmdbMap("country", mmdbPointer(stringOffset, false))...)
+
+			r := &mmdbReader{buf: buf}
+			got, next, err := r.decode(0)
+			if err != nil {
+				t.Errorf("pointer to %d (long %t): decode failed: %v", target, long, err)
+				continue
+			}
+			if want := map[string]any{"country": "France"}; !reflect.DeepEqual(got, want) {
+				t.Errorf("pointer to %d (long %t): decode = %#v, want %#v", target, long, got, want)
+			}
+			if next != uint64(len(pointer)) {
+				t.Errorf("pointer to %d (long %t): decode ends at %d, want %d", target, long, next, len(pointer))
+			}
+		}
+	}
+}
+
+func TestMmdbRecord(t *testing.T) {
+	// the second node of each tree, after a node of zeroes
+	tests := []struct {
+		recordSize  uint64
+		node        []byte
+		left, right uint64
+	}{
+		{24, []byte{0xab, 0xcd, 0xef, 0x12, 0x34, 0x56}, 0xabcdef, 0x123456},
+		{28, []byte{0xbc, 0xde, 0xf1, 0xa9, 0x23, 0x45, 0x67}, 0xabcdef1, 0x9234567},
+		{32, []byte{0xfe, 0xdc, 0xba, 0x98, 0x01, 0x23, 0x45, 0x67}, 0xfedcba98, 0x01234567},
+	}
+
+	for _, test := range tests {
+		r := &mmdbReader{buf: append(make([]byte, len(test.node)), test.node...), recordSize: test.recordSize}
+		if got := r.record(1, 0); got != test.left {
+			t.Errorf("record size %d: left record = %x, want %x", test.recordSize, got, test.left)
+		}
+		if got := r.record(1, 1); got != test.right {
+			t.Errorf("record size %d: right record = %x, want %x", test.recordSize, got, test.right)
+		}
+	}
+}
+
+// mmdbTree is a search tree being built, each node holding two records
+// which are node numbers, or -1 for no data, or data offsets once leaves.
+type mmdbTree struct {
+	nodes  [][2]int
+	leaves map[[2]int]int
+}
+
+// insert points the network of a prefix at a data offset. Networks must not
+// overlap.
+func (tree *mmdbTree) insert(prefix netip.Prefix, bitsBefore int, dataOffset int) {
+	bits := prefix.Addr().AsSlice()
+	node := 0
+	for i := range prefix.Bits() + bitsBefore {
+		bit := 0
+		if i >= bitsBefore {
+			j := i - bitsBefore
+			bit = int(bits[j/8] >> (7 - j%8) & 1)
+		}
+		if i == prefix.Bits()+bitsBefore-1 {
+			tree.leaves[[2]int{node, bit}] = dataOffset
+			return
+		}
+		if tree.nodes[node][bit] < 0 {
+			tree.nodes = append(tree.nodes, [2]int{-1, -1})
+			tree.nodes[node][bit] = len(tree.nodes) - 1
+		}
+		node = tree.nodes[node][bit]
+	}
+}
+
+// bytes serializes the tree with records of recordSize bits.
+func (tree *mmdbTree) bytes(recordSize int) []byte {
+	nodeCount := len(tree.nodes)
+	var b []byte
+	for n, node := range tree.nodes {
+		var records [2]uint32
+		for bit, record := range node {
+			if offset, ok := tree.leaves[[2]int{n, bit}]; ok {
+				records[bit] = uint32(nodeCount + mmdbDataSeparator + offset)
+			} else if record < 0 {
+				records[bit] = uint32(nodeCount)
+			} else {
+				records[bit] = uint32(record)
+			}
+		}
+
+		switch recordSize {
+		case 24:
+			b = append(b, byte(records[0]>>16), byte(records[0]>>8), byte(records[0]))
+			b = append(b, byte(records[1]>>16), byte(records[1]>>8), byte(records[1]))
+		case 28:
+			b = append(b, byte(records[0]>>16), byte(records[0]>>8), byte(records[0]))
+			b = append(b, byte(records[0]>>24)<<4|byte(records[1]>>24)&0x0f)
+			b = append(b, byte(records[1]>>16), byte(records[1]>>8), byte(records[1]))
+		case 32:
+			b = binary.BigEndian.AppendUint32(b, records[0])
+			b = binary.BigEndian.AppendUint32(b, records[1])
+		}
+	}
+	return b
+}
+
+// writeTestMmdb writes a database where 192.0.2.0/24 is in Paris,
+// 2001:db8::/32 in Lyon and 198.51.100.128/25 has no location.
+func writeTestMmdb(t *testing.T, recordSize int, ipVersion int) string {
+	t.Helper()
+
+	france := mmdbMap("iso_code", mmdbString("FR"), "names", mmdbMap("en", mmdbString("France"), "fr", mmdbString("France")))
+	data := append([]byte{}, france...)
+	paris := len(data)
+	data = append(data, mmdbMap(
+		"city", mmdbMap("names", mmdbMap("en", mmdbString("Paris"))),
+		"country", mmdbPointer(0, false),
+		"location", mmdbMap("accuracy_radius", mmdbUint16(20), "latitude", mmdbDouble(48.8566), "longitude", mmdbDouble(2.3522)),
+	)...)
+	lyon := len(data)
+	data = append(data, mmdbMap(
+		"city", mmdbMap("names", mmdbMap("fr", mmdbString("Lyon"), "en", mmdbString("Lyons"))),
+		"country", mmdbPointer(0, true),
+		"location", mmdbMap("latitude", mmdbDouble(45.764), "longitude", mmdbDouble(4.8357)),
+	)...)
+	unlocated := len(data)
+	data = append(data, mmdbMap("country", mmdbPointer(0, false))...)
+
+	tree := &mmdbTree{nodes: [][2]int{{-1, -1}}, leaves: map[[2]int]int{}}
+	ipv4Bits := 0
+	if ipVersion == 6 {
+		ipv4Bits = 96
+		tree.insert(netip.MustParsePrefix("2001:db8::/32"), 0, lyon)
+	}
+	tree.insert(netip.MustParsePrefix("192.0.2.0/24"), ipv4Bits, paris)
+	tree.insert(netip.MustParsePrefix("198.51.100.128/25"), ipv4Bits, unlocated)
+
+	file := tree.bytes(recordSize)
+	file = append(file, make([]byte, mmdbDataSeparator)...)
+	file = append(file, data...)
+	file = append(file, mmdbMetadataMarker...)
+	file = append(file, mmdbMap(
+		"node_count", mmdbValue(6, 4, binary.BigEndian.AppendUint32(nil, uint32(len(tree.nodes)))...),
+		"record_size", mmdbUint16(uint16(recordSize)),
+		"ip_version", mmdbUint16(uint16(ipVersion)),
+		"database_type", mmdbString("Test-City"),
+	)...)
+
+	path := filepath.Join(t.TempDir(), "test.mmdb")
+	err := os.WriteFile(path, file, 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestMmdbLookup(t *testing.T) {
+	paris := map[string]any{
+		"city":     map[string]any{"names": map[string]any{"en": "Paris"}},
+		"country":  map[string]any{"iso_code": "FR", "names": map[string]any{"en": "France", "fr": "France"}},
+		"location": map[string]any{"accuracy_radius": uint64(20), "latitude": 48.8566, "longitude": 2.3522},
+	}
+
+	for _, recordSize := range []int{24, 28, 32} {
+		r, err := openMmdb(writeTestMmdb(t, recordSize, 6))
+		if err != nil {
+			t.Fatalf("record size %d: %v", recordSize, err)
+		}
+
+		tests := []struct {
+			addr string
+			want any
+		}{
+			{"192.0.2.1", paris},
+			{"192.0.2.255", paris},
+			{"::ffff:192.0.2.1", paris},
+			{"192.0.3.1", nil},
+			{"198.51.100.1", nil},
+			{"2001:db8::1", "Lyon"},
+			{"2001:db8:ffff::1", "Lyon"},
+			{"2001:db9::1", nil},
+		}
+		for _, test := range tests {
+			got, err := r.Lookup(netip.MustParseAddr(test.addr))
+			if err != nil {
+				t.Errorf("record size %d: Lookup(%s) failed: %v", recordSize, test.addr, err)
+				continue
+			}
+			if name, ok := test.want.(string); ok {
+				got = mmdbPath(got, "city", "names", "fr")
+				if got != name {
+					t.Errorf("record size %d: Lookup(%s) city = %v, want %s", recordSize, test.addr, got, name)
+				}
+			} else if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("record size %d: Lookup(%s) = %#v, want %#v", recordSize, test.addr, got, test.want)
+			}
+		}
+
+		got, err := r.Lookup(netip.MustParseAddr("198.51.100.200"))
+		if err != nil || mmdbName(mmdbPath(got, "country")) != "France" || mmdbPath(got, "location") != nil {
+			t.Errorf("record size %d: Lookup(198.51.100.200) = %#v, %v, want a country without location", recordSize, got, err)
+		}
+	}
+
+	r, err := openMmdb(writeTestMmdb(t, 24, 4))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := r.Lookup(netip.MustParseAddr("192.0.2.1"))
+	if err != nil || !reflect.DeepEqual(got, paris) {
+		t.Errorf("IPv4 database: Lookup(192.0.2.1) = %#v, %v, want %#v", got, err, paris)
+	}
+	got, err = r.Lookup(netip.MustParseAddr("2001:db8::1"))
+	if err != nil || got != nil {
+		t.Errorf("IPv4 database: Lookup(2001:db8::1) = %#v, %v, want nothing", got, err)
+	}
+}
+
+func TestOpenMmdbInvalid(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "invalid.mmdb")
+	err := os.WriteFile(path, []byte("not a database"), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = openMmdb(path)
+	if err == nil {
+		t.Error("openMmdb accepted a file without metadata")
+	}
+
+	valid, err := os.ReadFile(writeTestMmdb(t, 24, 6))
+	if err != nil {
+		t.Fatal(err)
+	}
+	unsupported := bytes.Replace(valid, append(mmdbString("record_size"), mmdbUint16(24)...), append(mmdbString("record_size"), mmdbUint16(20)...), 1)
+	err = os.WriteFile(path, unsupported, 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = openMmdb(path)
+	if err == nil {
+		t.Error("openMmdb accepted a record size of 20 bits")
+	}
+}
+
+func TestLocateClient(t *testing.T) {
+	r, err := openMmdb(writeTestMmdb(t, 28, 6))
+	if err != nil {
+		t.Fatal(err)
+	}
+	previous := geoIpDatabase.Swap(r)
+	t.Cleanup(func() { geoIpDatabase.Store(previous) })
+
+	tests := []struct {
+		remoteAddr string
+		want       *GeoIpLocation
+	}{
+		{"192.0.2.10:443", &GeoIpLocation{Lat: 48.8566, Lon: 2.3522, AccuracyRadius: 20, City: "Paris", Country: "France"}},
+		{"[2001:db8::10]:443", &GeoIpLocation{Lat: 45.764, Lon: 4.8357, City: "Lyon", Country: "France"}},
+		{"198.51.100.200:443", nil},
+		{"203.0.113.1:443", nil},
+	}
+	for _, test := range tests {
+		request := httptest.NewRequest("GET", "/", nil)
+		request.RemoteAddr = test.remoteAddr
+		got, ok := locateClient(request)
+		if ok != (test.want != nil) || (ok && *got != *test.want) {
+			t.Errorf("locateClient from %s = %+v, %t, want %+v", test.remoteAddr, got, ok, test.want)
+		}
+	}
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+)
+
+// Mapbox Vector Tile encoding, following
+// https://github.com/mapbox/vector-tile-spec/tree/master/2.1
+
+const (
+	mvtVersion    = 2
+	mvtExtent     = 4096
+	mvtPointType  = 1
+	mvtMoveToCmd  = 1
+	mvtLayerField = 3
+)
+
+type mvtFeature struct {
+	Id         uint64
+	X, Y       int
+	Properties map[string]any
+}
+
+// mvtLayer accumulates point features for a single tile layer, interning
+// property keys and values as required by the format.
+type mvtLayer struct {
+	Name     string
+	features []protoBuffer
+	keys     []string
+	keyIdx   map[string]uint32
+	values   []any
+	valueIdx map[any]uint32
+}
+
+func newMvtLayer(name string) *mvtLayer {
+	return &mvtLayer{Name: name, keyIdx: map[string]uint32{}, valueIdx: map[any]uint32{}}
+}
+
+func (l *mvtLayer) key(k string) uint32 {
+	i, ok := l.keyIdx[k]
+	if !ok {
+		i = uint32(len(l.keys))
+		l.keys = append(l.keys, k)
+		l.keyIdx[k] = i
+	}
+	return i
+}
+
+func (l *mvtLayer) value(v any) uint32 {
+	i, ok := l.valueIdx[v]
+	if !ok {
+		i = uint32(len(l.values))
+		l.values = append(l.values, v)
+		l.valueIdx[v] = i
+	}
+	return i
+}
+
+// AddPoint adds a point feature at tile coordinates x, y in [0, mvtExtent).
+func (l *mvtLayer) AddPoint(f mvtFeature) {
+	keys := make([]string, 0, len(f.Properties))
+	for k := range f.Properties {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var tags []uint32
+	for _, k := range keys {
+		tags = append(tags, l.key(k), l.value(f.Properties[k]))
+	}
+
+	var feature protoBuffer
+	feature.Uint(1, f.Id)
+	feature.PackedUint(2, tags)
+	feature.Uint(3, mvtPointType)
+	feature.PackedUint(4, []uint32{
+		mvtMoveToCmd&0x7 | 1<<3,
+		uint32(zigzag(int64(f.X))),
+		uint32(zigzag(int64(f.Y))),
+	})
+	l.features = append(l.features, feature)
+}
+
+func (l *mvtLayer) encode() (protoBuffer, error) {
+	var layer protoBuffer
+	layer.Uint(15, mvtVersion)
+	layer.String(1, l.Name)
+	for _, feature := range l.features {
+		layer.Bytes(2, feature)
+	}
+	for _, k := range l.keys {
+		layer.String(3, k)
+	}
+	for _, v := range l.values {
+		var value protoBuffer
+		switch v := v.(type) {
+		case string:
+			value.String(1, v)
+		case float64:
+			value.Double(3, v)
+		case int:
+			if v >= 0 {
+				value.Uint(5, uint64(v))
+			} else {
+				value.Sint(6, int64(v))
+			}
+		case bool:
+			value.Bool(7, v)
+		default:
+			return nil, errors.New(fmt.Sprintf("unsupported vector tile value %T", v))
+		}
+		layer.Bytes(4, value)
+	}
+	layer.Uint(5, mvtExtent)
+
+	return layer, nil
+}
+
+// EncodeTile serializes layers into a vector tile.
+func EncodeTile(layers ...*mvtLayer) ([]byte, error) {
+	var tile protoBuffer
+	for _, l := range layers {
+		layer, err := l.encode()
+		if err != nil {
+			return nil, err
+		}
+		tile.Bytes(mvtLayerField, layer)
+	}
+
+	return tile, nil
+}
+
+// tileBBox returns the area covered by tile x, y at zoom z.
+func tileBBox(z, x, y int) BBox {
+	north, west := mercatorLatLon(float64(x*tileSize), float64(y*tileSize), z)
+	south, east := mercatorLatLon(float64((x+1)*tileSize), float64((y+1)*tileSize), z)
+
+	return BBox{West: west, South: south, East: east, North: north}
+}
+
+// tileCoordinates projects a coordinate into the extent of tile x, y at zoom z.
+func tileCoordinates(lat, lon float64, z, x, y int) (int, int) {
+	px, py := mercatorPixel(lat, lon, z)
+	scale := float64(mvtExtent) / tileSize
+
+	return int(math.Round((px - float64(x*tileSize)) * scale)), int(math.Round((py - float64(y*tileSize)) * scale))
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"slices"
+	"strings"
+	"unicode"
+)
+
+// Fuzzy text matching compares the trigrams of texts folded to lowercase
+// ASCII, so that accents, case and punctuation do not matter and typos
+// only cost the trigrams around them.
+
+var foldedRunes = map[rune]string{
+	'à': "a", 'á': "a", 'â': "a", 'ã': "a", 'ä': "a", 'å': "a",
+	'ç': "c",
+	'è': "e", 'é': "e", 'ê': "e", 'ë': "e",
+	'ì': "i", 'í': "i", 'î': "i", 'ï': "i",
+	'ñ': "n",
+	'ò': "o", 'ó': "o", 'ô': "o", 'õ': "o", 'ö': "o",
+	'ù': "u", 'ú': "u", 'û': "u", 'ü': "u",
+	'ý': "y", 'ÿ': "y",
+	'œ': "oe", 'æ': "ae", 'ß': "ss",
+}
+
+// foldText lowercases a text, removes accents and replaces anything but
+// letters and digits by single spaces.
+func foldText(s string) string {
+	var folded strings.Builder
+	space := true
+	for _, r := range strings.ToLower(s) {
+		switch {
+		case foldedRunes[r] != "":
+			folded.WriteString(foldedRunes[r])
+			space = false
+		case r < unicode.MaxASCII && (unicode.IsLetter(r) || unicode.IsDigit(r)):
+			folded.WriteRune(r)
+			space = false
+		case !space:
+			folded.WriteByte(' ')
+			space = true
+		}
+	}
+	return strings.TrimSpace(folded.String())
+}
+
+// trigrams returns the distinct trigrams of a folded text, each word being
+// padded with two spaces before and one after. With partial, the last word
+// is taken as a prefix and gets no trailing space.
+func trigrams(folded string, partial bool) []string {
+	words := strings.Fields(folded)
+	var grams []string
+	for i, word := range words {
+		padded := "  " + word + " "
+		if partial && i == len(words)-1 {
+			padded = "  " + word
+		}
+		for j := 0; j+3 <= len(padded); j++ {
+			grams = append(grams, padded[j:j+3])
+		}
+	}
+
+	slices.Sort(grams)
+	return slices.Compact(grams)
+}
+
+// trigramIndex finds the documents, texts identified by their position,
+// sharing the most trigrams with a query.
+type trigramIndex struct {
+	postings map[string][]int32
+	counts   []int
+}
+
+type trigramMatch struct {
+	Doc int32
+	// mean of the share of the query trigrams found in the document and of
+	// the Dice coefficient of both trigram sets, 1 for identical texts, so
+	// that documents containing the query rank first, shortest first
+	Score float64
+}
+
+func newTrigramIndex() *trigramIndex {
+	return &trigramIndex{postings: map[string][]int32{}}
+}
+
+// Add indexes a folded text as the next document, returning its number.
+func (t *trigramIndex) Add(folded string) int32 {
+	doc := int32(len(t.counts))
+	grams := trigrams(folded, false)
+	for _, gram := range grams {
+		t.postings[gram] = append(t.postings[gram], doc)
+	}
+	t.counts = append(t.counts, len(grams))
+	return doc
+}
+
+// Search returns the documents scoring at least minScore for a folded
+// query, best first.
+func (t *trigramIndex) Search(folded string, partial bool, minScore float64) []trigramMatch {
+	grams := trigrams(folded, partial)
+	if len(grams) == 0 {
+		return nil
+	}
+
+	common := map[int32]int{}
+	for _, gram := range grams {
+		for _, doc := range t.postings[gram] {
+			common[doc]++
+		}
+	}
+
+	matches := []trigramMatch{}
+	for doc, count := range common {
+		coverage := float64(count) / float64(len(grams))
+		dice := 2 * float64(count) / float64(len(grams)+t.counts[doc])
+		score := (coverage + dice) / 2
+		if score >= minScore {
+			matches = append(matches, trigramMatch{Doc: doc, Score: score})
+		}
+	}
+	slices.SortFunc(matches, func(a trigramMatch, b trigramMatch) int {
+		if a.Score != b.Score {
+			if a.Score > b.Score {
+				return -1
+			}
+			return 1
+		}
+		return int(a.Doc - b.Doc)
+	})
+
+	return matches
+}
@@ -0,0 +1,388 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Streaming readers for OpenStreetMap extracts, either XML (.osm) or PBF
+// (.osm.pbf, https://wiki.openstreetmap.org/wiki/PBF_Format). Only nodes
+// and ways are read; relations are skipped.
+
+type osmHandler struct {
+	// either can be nil to skip that kind of element
+	Node func(id int64, lat, lon float64)
+	Way  func(id int64, refs []int64, tags map[string]string)
+}
+
+// readOsmFile reads an extract, choosing the format from the file name.
+func readOsmFile(path string, handler osmHandler) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if strings.HasSuffix(path, ".pbf") {
+		return readOsmPbf(bufio.NewReader(f), handler)
+	}
+	return readOsmXml(bufio.NewReader(f), handler)
+}
+
+func readOsmXml(r io.Reader, handler osmHandler) error {
+	dec := xml.NewDecoder(r)
+	var wayId int64
+	var refs []int64
+	var tags map[string]string
+	inWay := false
+
+	attr := func(e xml.StartElement, name string) string {
+		for _, a := range e.Attr {
+			if a.Name.Local == name {
+				return a.Value
+			}
+		}
+		return ""
+	}
+
+	for {
+		token, err := dec.Token()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		switch e := token.(type) {
+		case xml.StartElement:
+			switch e.Name.Local {
+			case "node":
+				if handler.Node == nil {
+					continue
+				}
+				id, err := strconv.ParseInt(attr(e, "id"), 10, 64)
+				if err != nil {
+					return err
+				}
+				lat, err := strconv.ParseFloat(attr(e, "lat"), 64)
+				if err != nil {
+					return err
+				}
+				lon, err := strconv.ParseFloat(attr(e, "lon"), 64)
+				if err != nil {
+					return err
+				}
+				handler.Node(id, lat, lon)
+			case "way":
+				wayId, err = strconv.ParseInt(attr(e, "id"), 10, 64)
+				if err != nil {
+					return err
+				}
+				refs, tags, inWay = nil, map[string]string{}, true
+			case "nd":
+				if inWay {
+					ref, err := strconv.ParseInt(attr(e, "ref"), 10, 64)
+					if err != nil {
+						return err
+					}
+					refs = append(refs, ref)
+				}
+			case "tag":
+				if inWay {
+					tags[attr(e, "k")] = attr(e, "v")
+				}
+			}
+		case xml.EndElement:
+			if e.Name.Local == "way" {
+				inWay = false
+				if handler.Way != nil {
+					handler.Way(wayId, refs, tags)
+				}
+			}
+		}
+	}
+}
+
+const maxPbfBlobSize = 32 << 20
+
+func readOsmPbf(r io.Reader, handler osmHandler) error {
+	for {
+		var size uint32
+		err := binary.Read(r, binary.BigEndian, &size)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if size > 64<<10 {
+			return errors.New("pbf blob header too large")
+		}
+
+		header := make([]byte, size)
+		_, err = io.ReadFull(r, header)
+		if err != nil {
+			return err
+		}
+
+		var blobType string
+		var dataSize uint64
+		d := newProtoDecoder(header)
+		for d.Next() {
+			switch d.Field {
+			case 1:
+				blobType = string(d.Bytes())
+			case 3:
+				dataSize = d.Uint()
+			default:
+				d.Skip()
+			}
+		}
+		if d.Err() != nil {
+			return d.Err()
+		}
+		if dataSize > maxPbfBlobSize {
+			return errors.New("pbf blob too large")
+		}
+
+		blob := make([]byte, dataSize)
+		_, err = io.ReadFull(r, blob)
+		if err != nil {
+			return err
+		}
+
+		data, err := pbfBlobData(blob)
+		if err != nil {
+			return err
+		}
+
+		switch blobType {
+		case "OSMHeader":
+			err = checkPbfHeader(data)
+		case "OSMData":
+			err = readPbfPrimitiveBlock(data, handler)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func pbfBlobData(blob []byte) ([]byte, error) {
+	d := newProtoDecoder(blob)
+	for d.Next() {
+		switch d.Field {
+		case 1:
+			return d.Bytes(), nil
+		case 3:
+			z, err := zlib.NewReader(bytes.NewReader(d.Bytes()))
+			if err != nil {
+				return nil, err
+			}
+			defer z.Close()
+			return io.ReadAll(io.LimitReader(z, maxPbfBlobSize))
+		case 4, 5, 6, 7:
+			return nil, errors.New("only raw and zlib pbf blobs are supported")
+		default:
+			d.Skip()
+		}
+	}
+	if d.Err() != nil {
+		return nil, d.Err()
+	}
+	return nil, errors.New("empty pbf blob")
+}
+
+func checkPbfHeader(data []byte) error {
+	d := newProtoDecoder(data)
+	for d.Next() {
+		if d.Field == 4 {
+			feature := string(d.Bytes())
+			if feature != "OsmSchema-V0.6" && feature != "DenseNodes" {
+				return errors.New(fmt.Sprintf("unsupported pbf feature: %s", feature))
+			}
+		} else {
+			d.Skip()
+		}
+	}
+	return d.Err()
+}
+
+type pbfBlock struct {
+	strings     [][]byte
+	granularity int64
+	latOffset   int64
+	lonOffset   int64
+}
+
+func (b pbfBlock) coord(offset, value int64) float64 {
+	return 1e-9 * float64(offset+b.granularity*value)
+}
+
+func readPbfPrimitiveBlock(data []byte, handler osmHandler) error {
+	block := pbfBlock{granularity: 100}
+	var groups [][]byte
+
+	d := newProtoDecoder(data)
+	for d.Next() {
+		switch d.Field {
+		case 1:
+			table := newProtoDecoder(d.Bytes())
+			for table.Next() {
+				if table.Field == 1 {
+					block.strings = append(block.strings, table.Bytes())
+				} else {
+					table.Skip()
+				}
+			}
+			if table.Err() != nil {
+				return table.Err()
+			}
+		case 2:
+			groups = append(groups, d.Bytes())
+		case 17:
+			block.granularity = int64(d.Uint())
+		case 19:
+			block.latOffset = int64(d.Uint())
+		case 20:
+			block.lonOffset = int64(d.Uint())
+		default:
+			d.Skip()
+		}
+	}
+	if d.Err() != nil {
+		return d.Err()
+	}
+
+	for _, group := range groups {
+		g := newProtoDecoder(group)
+		for g.Next() {
+			var err error
+			switch {
+			case g.Field == 1 && handler.Node != nil:
+				err = readPbfNode(g.Bytes(), block, handler)
+			case g.Field == 2 && handler.Node != nil:
+				err = readPbfDenseNodes(g.Bytes(), block, handler)
+			case g.Field == 3 && handler.Way != nil:
+				err = readPbfWay(g.Bytes(), block, handler)
+			default:
+				g.Skip()
+			}
+			if err != nil {
+				return err
+			}
+		}
+		if g.Err() != nil {
+			return g.Err()
+		}
+	}
+
+	return nil
+}
+
+func readPbfNode(data []byte, block pbfBlock, handler osmHandler) error {
+	var id, lat, lon int64
+	d := newProtoDecoder(data)
+	for d.Next() {
+		switch d.Field {
+		case 1:
+			id = d.Sint()
+		case 8:
+			lat = d.Sint()
+		case 9:
+			lon = d.Sint()
+		default:
+			d.Skip()
+		}
+	}
+	if d.Err() != nil {
+		return d.Err()
+	}
+
+	handler.Node(id, block.coord(block.latOffset, lat), block.coord(block.lonOffset, lon))
+	return nil
+}
+
+func readPbfDenseNodes(data []byte, block pbfBlock, handler osmHandler) error {
+	var ids, lats, lons []int64
+	d := newProtoDecoder(data)
+	for d.Next() {
+		switch d.Field {
+		case 1:
+			ids = d.PackedSints()
+		case 8:
+			lats = d.PackedSints()
+		case 9:
+			lons = d.PackedSints()
+		default:
+			d.Skip()
+		}
+	}
+	if d.Err() != nil {
+		return d.Err()
+	}
+	if len(lats) != len(ids) || len(lons) != len(ids) {
+		return errors.New("inconsistent pbf dense nodes")
+	}
+
+	// values are delta coded
+	var id, lat, lon int64
+	for i := range ids {
+		id += ids[i]
+		lat += lats[i]
+		lon += lons[i]
+		handler.Node(id, block.coord(block.latOffset, lat), block.coord(block.lonOffset, lon))
+	}
+	return nil
+}
+
+func readPbfWay(data []byte, block pbfBlock, handler osmHandler) error {
+	var id int64
+	var keys, vals []uint64
+	var refs []int64
+	d := newProtoDecoder(data)
+	for d.Next() {
+		switch d.Field {
+		case 1:
+			id = int64(d.Uint())
+		case 2:
+			keys = d.PackedUints()
+		case 3:
+			vals = d.PackedUints()
+		case 8:
+			refs = d.PackedSints()
+		default:
+			d.Skip()
+		}
+	}
+	if d.Err() != nil {
+		return d.Err()
+	}
+	if len(keys) != len(vals) {
+		return errors.New("inconsistent pbf way tags")
+	}
+
+	tags := map[string]string{}
+	for i := range keys {
+		if keys[i] >= uint64(len(block.strings)) || vals[i] >= uint64(len(block.strings)) {
+			return errors.New("pbf string index out of range")
+		}
+		tags[string(block.strings[keys[i]])] = string(block.strings[vals[i]])
+	}
+
+	for i := 1; i < len(refs); i++ {
+		refs[i] += refs[i-1]
+	}
+	handler.Way(id, refs, tags)
+	return nil
+}
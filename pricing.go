@@ -0,0 +1,277 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"math"
+	"time"
+)
+
+// Pricing plans come from the GBFS system_pricing_plans feed. A plan applies
+// to the bike types whose vehicle_types entry lists it, which is how e-bike
+// surcharges are published, or to any bike when no vehicle type does.
+
+const pricingInterval = time.Hour
+
+// PricingSegment charges Rate every Interval minutes of a ride from Start
+// to End minutes, or Rate once when Interval is zero.
+type PricingSegment struct {
+	Start    float64  `json:"start"`
+	Rate     float64  `json:"rate"`
+	Interval float64  `json:"interval"`
+	End      *float64 `json:"end,omitempty"`
+}
+
+type PricingPlan struct {
+	PlanId   string
+	Name     string
+	Currency string
+	// price of the plan itself, such as a pass or subscription
+	Price       float64
+	Description string
+	// mechanical, ebike, or empty for any bike
+	Bike          string `json:",omitempty"`
+	PerMinPricing []PricingSegment
+	// minutes of a ride before any charge, when some
+	IncludedMinutes *float64 `json:",omitempty"`
+}
+
+type CostEstimate struct {
+	PlanId   string
+	Name     string
+	Currency string
+	// mechanical or ebike
+	Bike string
+	// per rider, excluding the price of the plan itself
+	Cost float64
+}
+
+// RideCost returns the price of a ride of the given minutes.
+func (p PricingPlan) RideCost(minutes float64) float64 {
+	cost := 0.0
+	for _, segment := range p.PerMinPricing {
+		if minutes <= segment.Start {
+			continue
+		}
+		if segment.Interval <= 0 {
+			cost += segment.Rate
+			continue
+		}
+
+		end := minutes
+		if segment.End != nil {
+			end = math.Min(end, *segment.End)
+		}
+		cost += segment.Rate * math.Ceil((end-segment.Start)/segment.Interval)
+	}
+	return cost
+}
+
+func (p PricingPlan) includedMinutes() *float64 {
+	for _, segment := range p.PerMinPricing {
+		if segment.Rate > 0 {
+			return &segment.Start
+		}
+	}
+	return nil
+}
+
+func (p PricingPlan) appliesTo(bike string) bool {
+	return p.Bike == "" || p.Bike == bike
+}
+
+// refreshPricingPlans replaces the stored plans by those of the feed, unless
+// it lists none.
+func refreshPricingPlans() error {
+	var plans struct {
+		Data struct {
+			Plans []struct {
+				PlanId        string           `json:"plan_id"`
+				Name          json.RawMessage  `json:"name"`
+				Currency      string           `json:"currency"`
+				Price         json.RawMessage  `json:"price"`
+				Description   json.RawMessage  `json:"description"`
+				PerMinPricing []PricingSegment `json:"per_min_pricing"`
+			}
+		}
+	}
+	err := fetchGbfsFeed("system_pricing_plans", &plans)
+	if err != nil {
+		return err
+	}
+	// an empty list is more likely a broken feed than free rides, and would
+	// wipe every plan
+	if len(plans.Data.Plans) == 0 {
+		return errors.New("system_pricing_plans lists no plans, keeping the stored ones")
+	}
+
+	bikes, err := pricingPlanBikes()
+	if err != nil {
+		// the feed is optional, plans then apply to any bike
+		log.Print(err)
+	}
+
+	tx, err := db.BeginTx(context.Background(), nil)
+	if err != nil {
+		return err
+	}
+
+	for _, plan := range plans.Data.Plans {
+		price, err := gbfsFloat(plan.Price)
+		if err != nil {
+			return errors.Join(err, tx.Rollback())
+		}
+		segments, err := json.Marshal(plan.PerMinPricing)
+		if err != nil {
+			return errors.Join(err, tx.Rollback())
+		}
+
+		_, err = tx.Exec("INSERT INTO pricing_plans (plan_id, name, currency, price, description, bike, per_min_pricing, updated_at) VALUES ($1, $2, $3, $4, $5, $6, $7, NOW()) ON CONFLICT (plan_id) DO UPDATE SET name = EXCLUDED.name, currency = EXCLUDED.currency, price = EXCLUDED.price, description = EXCLUDED.description, bike = EXCLUDED.bike, per_min_pricing = EXCLUDED.per_min_pricing, updated_at = EXCLUDED.updated_at",
+			plan.PlanId, localizedText(plan.Name), plan.Currency, price, localizedText(plan.Description), bikes[plan.PlanId], segments)
+		if err != nil {
+			return errors.Join(err, tx.Rollback())
+		}
+	}
+
+	_, err = tx.Exec("DELETE FROM pricing_plans WHERE updated_at < NOW()")
+	if err != nil {
+		return errors.Join(err, tx.Rollback())
+	}
+
+	return tx.Commit()
+}
+
+// pricingPlanBikes maps plans to the bike type they are limited to, from
+// the vehicle_types feed. Plans used by both types are left out.
+func pricingPlanBikes() (map[string]string, error) {
+	var types struct {
+		Data struct {
+			VehicleTypes []struct {
+				PropulsionType       string   `json:"propulsion_type"`
+				DefaultPricingPlanId string   `json:"default_pricing_plan_id"`
+				PricingPlanIds       []string `json:"pricing_plan_ids"`
+			} `json:"vehicle_types"`
+		}
+	}
+	err := fetchGbfsFeed("vehicle_types", &types)
+	if err != nil {
+		return nil, err
+	}
+
+	bikes := map[string]string{}
+	shared := map[string]bool{}
+	for _, vehicleType := range types.Data.VehicleTypes {
+		bike := "mechanical"
+		if vehicleType.PropulsionType != "human" {
+			bike = "ebike"
+		}
+		for _, planId := range append(vehicleType.PricingPlanIds, vehicleType.DefaultPricingPlanId) {
+			if planId == "" {
+				continue
+			}
+			if other, ok := bikes[planId]; ok && other != bike {
+				shared[planId] = true
+			}
+			bikes[planId] = bike
+		}
+	}
+	for planId := range shared {
+		delete(bikes, planId)
+	}
+
+	return bikes, nil
+}
+
+func refreshPricingPlansPeriodically() {
+	ticker := time.NewTicker(pricingInterval)
+	defer ticker.Stop()
+	for {
+		err := refreshPricingPlans()
+		if err != nil {
+			log.Print(err)
+		}
+		<-ticker.C
+	}
+}
+
+func pricingPlans() ([]PricingPlan, error) {
+	rows, err := db.Query("SELECT plan_id, name, currency, price, description, bike, per_min_pricing FROM pricing_plans ORDER BY plan_id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	plans := []PricingPlan{}
+	for rows.Next() {
+		var plan PricingPlan
+		var segments []byte
+		err := rows.Scan(&plan.PlanId, &plan.Name, &plan.Currency, &plan.Price, &plan.Description, &plan.Bike, &segments)
+		if err != nil {
+			return nil, err
+		}
+		err = json.Unmarshal(segments, &plan.PerMinPricing)
+		if err != nil {
+			return nil, err
+		}
+		plan.IncludedMinutes = plan.includedMinutes()
+
+		plans = append(plans, plan)
+	}
+
+	return plans, rows.Err()
+}
+
+// estimateCosts prices the rides of an itinerary with each plan, for each
+// bike type the pickup stations have enough of for the riders, riding
+// times being those of that type.
+func estimateCosts(itinerary Itinerary, plans []PricingPlan, r TripRequest) []CostEstimate {
+	estimates := []CostEstimate{}
+	for _, bike := range []string{"mechanical", "ebike"} {
+		if r.Bike != "any" && r.Bike != bike {
+			continue
+		}
+
+		rides := []float64{}
+		available := true
+		for _, leg := range itinerary.Legs {
+			if leg.Mode != "ride" {
+				continue
+			}
+			count := leg.FromStation.MechanicalCount()
+			if bike == "ebike" {
+				count = leg.FromStation.EBikeCount
+			}
+			available = available && count >= r.Riders
+			rides = append(rides, rideSeconds(float64(leg.Meters), bike)/60)
+		}
+		if !available {
+			continue
+		}
+
+		for _, plan := range plans {
+			if !plan.appliesTo(bike) {
+				continue
+			}
+			cost := 0.0
+			for _, minutes := range rides {
+				cost += plan.RideCost(minutes)
+			}
+			estimates = append(estimates, CostEstimate{PlanId: plan.PlanId, Name: plan.Name, Currency: plan.Currency, Bike: bike, Cost: math.Round(cost*100) / 100})
+		}
+	}
+	return estimates
+}
+
+// withCosts attaches cost estimates to the itineraries of a plan.
+func withCosts(plan TripPlan, r TripRequest) error {
+	plans, err := pricingPlans()
+	if err != nil {
+		return err
+	}
+	for i := range plan.Itineraries {
+		plan.Itineraries[i].Costs = estimateCosts(plan.Itineraries[i], plans, r)
+	}
+	return nil
+}
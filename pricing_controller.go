@@ -0,0 +1,23 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+type PricingController struct{}
+
+func (c *PricingController) List(w http.ResponseWriter, r *http.Request) {
+	plans, err := pricingPlans()
+	if err != nil {
+		defer handleHttpError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(plans)
+	if err != nil {
+		defer handleHttpError(w, err)
+		return
+	}
+}
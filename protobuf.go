@@ -0,0 +1,185 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+)
+
+// protobuf wire types
+const (
+	wireVarint  = 0
+	wireFixed64 = 1
+	wireBytes   = 2
+	wireFixed32 = 5
+)
+
+// protoBuffer is a minimal protocol buffers encoder, enough to write the
+// messages we hand-craft without pulling in a protobuf library. Decoding is
+// done by protoDecoder.
+type protoBuffer []byte
+
+func (p *protoBuffer) key(field int, wireType int) {
+	*p = binary.AppendUvarint(*p, uint64(field)<<3|uint64(wireType))
+}
+
+func (p *protoBuffer) Uint(field int, v uint64) {
+	p.key(field, wireVarint)
+	*p = binary.AppendUvarint(*p, v)
+}
+
+func (p *protoBuffer) Sint(field int, v int64) {
+	p.key(field, wireVarint)
+	*p = binary.AppendUvarint(*p, zigzag(v))
+}
+
+func (p *protoBuffer) Bool(field int, v bool) {
+	if v {
+		p.Uint(field, 1)
+	} else {
+		p.Uint(field, 0)
+	}
+}
+
+func (p *protoBuffer) Double(field int, v float64) {
+	p.key(field, wireFixed64)
+	*p = binary.LittleEndian.AppendUint64(*p, math.Float64bits(v))
+}
+
+func (p *protoBuffer) Bytes(field int, b []byte) {
+	p.key(field, wireBytes)
+	*p = binary.AppendUvarint(*p, uint64(len(b)))
+	*p = append(*p, b...)
+}
+
+func (p *protoBuffer) String(field int, s string) {
+	p.Bytes(field, []byte(s))
+}
+
+// PackedUint writes a packed repeated uint32 field.
+func (p *protoBuffer) PackedUint(field int, vs []uint32) {
+	var packed []byte
+	for _, v := range vs {
+		packed = binary.AppendUvarint(packed, uint64(v))
+	}
+	p.Bytes(field, packed)
+}
+
+func zigzag(v int64) uint64 {
+	return uint64((v << 1) ^ (v >> 63))
+}
+
+// protoDecoder walks the fields of an encoded protocol buffers message.
+type protoDecoder struct {
+	data []byte
+	err  error
+	// current field, as set by Next
+	Field    int
+	WireType int
+}
+
+var errProtoTruncated = errors.New("truncated protobuf message")
+
+func newProtoDecoder(data []byte) *protoDecoder {
+	return &protoDecoder{data: data}
+}
+
+func (d *protoDecoder) readVarint() uint64 {
+	v, n := binary.Uvarint(d.data)
+	if n <= 0 {
+		d.err = errProtoTruncated
+		d.data = nil
+		return 0
+	}
+	d.data = d.data[n:]
+	return v
+}
+
+// Next moves to the next field, returning false at the end of the message
+// or on error, in which case Err is set.
+func (d *protoDecoder) Next() bool {
+	if d.err != nil || len(d.data) == 0 {
+		return false
+	}
+	key := d.readVarint()
+	d.Field = int(key >> 3)
+	d.WireType = int(key & 0x7)
+	return d.err == nil
+}
+
+func (d *protoDecoder) Err() error {
+	return d.err
+}
+
+func (d *protoDecoder) Uint() uint64 {
+	return d.readVarint()
+}
+
+func (d *protoDecoder) Sint() int64 {
+	return unzigzag(d.readVarint())
+}
+
+func (d *protoDecoder) Bytes() []byte {
+	n := d.readVarint()
+	if d.err != nil {
+		return nil
+	}
+	if n > uint64(len(d.data)) {
+		d.err = errProtoTruncated
+		d.data = nil
+		return nil
+	}
+	b := d.data[:n]
+	d.data = d.data[n:]
+	return b
+}
+
+// Skip ignores the current field's value.
+func (d *protoDecoder) Skip() {
+	switch d.WireType {
+	case wireVarint:
+		d.readVarint()
+	case wireBytes:
+		d.Bytes()
+	case wireFixed64, wireFixed32:
+		n := 8
+		if d.WireType == wireFixed32 {
+			n = 4
+		}
+		if len(d.data) < n {
+			d.err = errProtoTruncated
+			d.data = nil
+			return
+		}
+		d.data = d.data[n:]
+	default:
+		d.err = errors.New("unsupported protobuf wire type")
+	}
+}
+
+// PackedUints decodes the current field as a packed repeated varint.
+func (d *protoDecoder) PackedUints() []uint64 {
+	packed := newProtoDecoder(d.Bytes())
+	var vs []uint64
+	for len(packed.data) > 0 && packed.err == nil {
+		vs = append(vs, packed.readVarint())
+	}
+	if packed.err != nil {
+		d.err = packed.err
+	}
+	return vs
+}
+
+// PackedSints decodes the current field as a packed repeated sint.
+func (d *protoDecoder) PackedSints() []int64 {
+	uints := d.PackedUints()
+	vs := make([]int64, len(uints))
+	for i, v := range uints {
+		vs[i] = unzigzag(v)
+	}
+	return vs
+}
+
+func unzigzag(v uint64) int64 {
+	return int64(v>>1) ^ -int64(v&1)
+}
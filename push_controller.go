@@ -0,0 +1,25 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+)
+
+type PushController struct{}
+
+// ShowVapidKey returns the key to subscribe with, as applicationServerKey.
+func (c *PushController) ShowVapidKey(w http.ResponseWriter, r *http.Request) {
+	key, err := vapidPublicKey()
+	if err != nil {
+		defer handleHttpError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(map[string]string{"public_key": base64.RawURLEncoding.EncodeToString(key)})
+	if err != nil {
+		defer handleHttpError(w, err)
+		return
+	}
+}
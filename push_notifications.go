@@ -0,0 +1,86 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+)
+
+// PushNotification is what the service worker displays.
+type PushNotification struct {
+	Title string `json:"title"`
+	Body  string `json:"body"`
+	Url   string `json:"url"`
+}
+
+var availabilityLabels = map[string]string{
+	"bikes":      "bikes",
+	"ebikes":     "e-bikes",
+	"mechanical": "mechanical bikes",
+	"docks":      "free docks",
+}
+
+func pushNotification(event WatchEvent) ([]byte, error) {
+	if len(event.Stations) == 0 {
+		return nil, errors.New("watch event without stations")
+	}
+
+	station := event.Stations[0]
+	notification := PushNotification{
+		Title: fmt.Sprintf("%s available", availabilityLabels[event.Kind]),
+		Body:  fmt.Sprintf("%s: %d %s", station.Name, station.Available(event.Kind), availabilityLabels[event.Kind]),
+		Url:   "/stations/" + strconv.Itoa(station.StationId),
+	}
+	if len(event.Stations) > 1 {
+		notification.Body += fmt.Sprintf(" and %d other stations", len(event.Stations)-1)
+	}
+
+	return json.Marshal(notification)
+}
+
+// deliverPendingPushes sends the due push notifications, dropping
+// subscriptions the push service reports as gone along with their watches.
+func deliverPendingPushes() error {
+	rows, err := db.Query("SELECT d.id, d.payload, d.attempts, s.id, s.endpoint, s.p256dh, s.auth FROM push_deliveries d JOIN watches w ON w.id = d.watch_id JOIN push_subscriptions s ON s.id = w.push_subscription_id WHERE d.delivered_at IS NULL AND d.attempts < $1 AND d.next_attempt_at <= NOW() ORDER BY d.next_attempt_at LIMIT 100", maxDeliveryAttempts)
+	if err != nil {
+		return err
+	}
+
+	type delivery struct {
+		id             int
+		payload        string
+		attempts       int
+		subscriptionId int
+		subscription   PushSubscription
+	}
+	var deliveries []delivery
+	for rows.Next() {
+		var d delivery
+		err := rows.Scan(&d.id, &d.payload, &d.attempts, &d.subscriptionId, &d.subscription.Endpoint, &d.subscription.Keys.P256dh, &d.subscription.Keys.Auth)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		deliveries = append(deliveries, d)
+	}
+	rows.Close()
+	if rows.Err() != nil {
+		return rows.Err()
+	}
+
+	var errs []error
+	for _, d := range deliveries {
+		err := sendPush(d.subscription, []byte(d.payload))
+		if errors.Is(err, errPushSubscriptionGone) {
+			_, err = db.Exec("DELETE FROM push_subscriptions WHERE id = $1", d.subscriptionId)
+		} else {
+			err = recordDeliveryAttempt("push_deliveries", d.id, d.attempts, err)
+		}
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	return errors.Join(errs...)
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The ranking engine scores stations on several criteria, each normalized
+// to [0, 1] with 1 being best, and combines them as a weighted average.
+
+const (
+	// availability above this many bikes, or docks, is not worth more
+	availabilityMargin = 5
+	ebikeMargin        = 3
+	// data this old gets no staleness score
+	maxStaleness = 10 * time.Minute
+	// score given when a station has no reliability data yet
+	unknownReliability = 0.5
+)
+
+type RankingWeights struct {
+	Distance     float64 `json:"distance"`
+	Availability float64 `json:"availability"`
+	EBikes       float64 `json:"ebikes"`
+	Reliability  float64 `json:"reliability"`
+	Staleness    float64 `json:"staleness"`
+}
+
+// defaultRankingWeights can be overridden with VELIB_RANKING_WEIGHTS, in
+// the same format as the weights query parameter.
+var defaultRankingWeights = RankingWeights{Distance: 1, Availability: 0.5, EBikes: 0, Reliability: 0.3, Staleness: 0.2}
+
+// ScoreBreakdown holds each criterion's weighted contribution to Total.
+type ScoreBreakdown struct {
+	Total        float64
+	Distance     float64
+	Availability float64
+	EBikes       float64
+	Reliability  float64
+	Staleness    float64
+}
+
+// ParseRankingWeights applies "criterion:weight" pairs separated by commas,
+// e.g. "distance:1,ebikes:2", on top of base.
+func ParseRankingWeights(s string, base RankingWeights) (RankingWeights, error) {
+	weights := base
+	for _, pair := range strings.Split(s, ",") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+
+		name, value, ok := strings.Cut(pair, ":")
+		if !ok {
+			return base, errors.New(fmt.Sprintf("invalid weight: %s", pair))
+		}
+		weight, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+		if err != nil || math.IsNaN(weight) || weight < 0 || math.IsInf(weight, 0) {
+			return base, errors.New(fmt.Sprintf("invalid weight: %s", pair))
+		}
+
+		switch strings.TrimSpace(name) {
+		case "distance":
+			weights.Distance = weight
+		case "availability":
+			weights.Availability = weight
+		case "ebikes":
+			weights.EBikes = weight
+		case "reliability":
+			weights.Reliability = weight
+		case "staleness":
+			weights.Staleness = weight
+		default:
+			return base, errors.New(fmt.Sprintf("unknown ranking criterion: %s", name))
+		}
+	}
+
+	if weights.Distance+weights.Availability+weights.EBikes+weights.Reliability+weights.Staleness == 0 {
+		return base, errors.New("at least one weight must be positive")
+	}
+	return weights, nil
+}
+
+func loadRankingWeights() error {
+	s := os.Getenv("VELIB_RANKING_WEIGHTS")
+	if s == "" {
+		return nil
+	}
+
+	weights, err := ParseRankingWeights(s, defaultRankingWeights)
+	if err != nil {
+		return err
+	}
+	defaultRankingWeights = weights
+	return nil
+}
+
+func ratio(value, max float64) float64 {
+	if max <= 0 {
+		return 0
+	}
+	return math.Min(math.Max(value/max, 0), 1)
+}
+
+// scoreStation scores a station for someone needing a bike (need is bikes)
+// or a dock (need is docks), within radius meters, at time at.
+func scoreStation(station Station, need string, radius int, weights RankingWeights, at time.Time) ScoreBreakdown {
+	distance := 1 - ratio(float64(station.Distance), float64(radius))
+
+	availability := ratio(float64(station.BikeCount), availabilityMargin)
+	ebikes := ratio(float64(station.EBikeCount), ebikeMargin)
+	if need == "docks" {
+		availability = ratio(float64(station.DockCount), availabilityMargin)
+		ebikes = 0
+	}
+
+	reliability := unknownReliability
+	if station.Reliability != nil {
+		reliability = 1 - station.Reliability.EmptyShare
+		if need == "docks" {
+			reliability = 1 - station.Reliability.FullShare
+		}
+	}
+
+	staleness := 1 - ratio(float64(at.Sub(station.UpdateAt)), float64(maxStaleness))
+
+	total := weights.Distance + weights.Availability + weights.EBikes + weights.Reliability + weights.Staleness
+	round := func(v float64) float64 { return math.Round(v*1000) / 1000 }
+	score := ScoreBreakdown{
+		Distance:     round(weights.Distance * distance / total),
+		Availability: round(weights.Availability * availability / total),
+		EBikes:       round(weights.EBikes * ebikes / total),
+		Reliability:  round(weights.Reliability * reliability / total),
+		Staleness:    round(weights.Staleness * staleness / total),
+	}
+	score.Total = round(score.Distance + score.Availability + score.EBikes + score.Reliability + score.Staleness)
+
+	return score
+}
+
+// rankStations scores the stations and sorts them best first.
+func rankStations(stations []Station, need string, radius int, weights RankingWeights, at time.Time) error {
+	if at.IsZero() {
+		at = time.Now()
+	}
+	reliabilities, err := slotReliabilities(at)
+	if err != nil {
+		return err
+	}
+
+	for i, station := range stations {
+		reliability, ok := reliabilities[station.StationId]
+		if ok {
+			stations[i].Reliability = &reliability
+		}
+		score := scoreStation(stations[i], need, radius, weights, at)
+		stations[i].Score = &score
+	}
+	slices.SortStableFunc(stations, func(a Station, b Station) int {
+		if a.Score.Total > b.Score.Total {
+			return -1
+		}
+		if a.Score.Total < b.Score.Total {
+			return 1
+		}
+		return a.Distance - b.Distance
+	})
+
+	return nil
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"time"
+	// embedded, so that the network time zone loads on hosts without one
+	_ "time/tzdata"
+)
+
+// Reliability is computed per station, ISO weekday (1 is Monday) and hour
+// in Paris time, from the snapshots of the last reliabilityWindow. As
+// snapshots are taken every refresh, sample shares are time shares.
+
+const (
+	reliabilityWindow   = 28 * 24 * time.Hour
+	reliabilityInterval = time.Hour
+	networkTimeZone     = "Europe/Paris"
+)
+
+type ReliabilityFigures struct {
+	Samples    int
+	EmptyShare float64
+	FullShare  float64
+	// median minutes for an empty, or full, station to get a bike, or a
+	// dock, back, for episodes starting in the slot
+	EmptyRecoveryMinutes *float64
+	FullRecoveryMinutes  *float64
+}
+
+type SlotReliability struct {
+	Weekday int
+	Hour    int
+	ReliabilityFigures
+}
+
+// StationReliability holds overall figures, which have no slot, and the
+// figures of each slot.
+type StationReliability struct {
+	StationId int `json:"station_id"`
+	ReliabilityFigures
+	ByHour []SlotReliability
+}
+
+const reliabilitySharesQuery = `
+INSERT INTO station_reliability (station_id, weekday, hour, samples, empty_share, full_share)
+SELECT station_id,
+	EXTRACT(ISODOW FROM recorded_at AT TIME ZONE '` + networkTimeZone + `')::int,
+	EXTRACT(HOUR FROM recorded_at AT TIME ZONE '` + networkTimeZone + `')::int,
+	COUNT(*), AVG((bike_count = 0)::int), AVG((dock_count = 0)::int)
+FROM station_history
+WHERE recorded_at > $1
+GROUP BY 1, 2, 3`
+
+// episodes are runs of consecutive snapshots with the same state, the
+// recovery time of an empty (or full) episode being its length
+const reliabilityRecoveryQuery = `
+WITH flagged AS (
+	SELECT station_id, recorded_at, bike_count = 0 AS empty, dock_count = 0 AS full,
+		LAG(bike_count = 0) OVER w AS was_empty, LAG(dock_count = 0) OVER w AS was_full
+	FROM station_history
+	WHERE recorded_at > $1
+	WINDOW w AS (PARTITION BY station_id ORDER BY recorded_at)
+), starts AS (
+	SELECT station_id, recorded_at, empty, full FROM flagged
+	WHERE empty IS DISTINCT FROM was_empty OR full IS DISTINCT FROM was_full
+), episodes AS (
+	SELECT station_id, recorded_at AS started_at, empty, full,
+		LEAD(recorded_at) OVER (PARTITION BY station_id ORDER BY recorded_at) AS ended_at
+	FROM starts
+), recoveries AS (
+	SELECT station_id,
+		EXTRACT(ISODOW FROM started_at AT TIME ZONE '` + networkTimeZone + `')::int AS weekday,
+		EXTRACT(HOUR FROM started_at AT TIME ZONE '` + networkTimeZone + `')::int AS hour,
+		percentile_cont(0.5) WITHIN GROUP (ORDER BY EXTRACT(EPOCH FROM ended_at - started_at) / 60) FILTER (WHERE empty) AS empty_recovery,
+		percentile_cont(0.5) WITHIN GROUP (ORDER BY EXTRACT(EPOCH FROM ended_at - started_at) / 60) FILTER (WHERE full) AS full_recovery
+	FROM episodes
+	WHERE ended_at IS NOT NULL
+	GROUP BY 1, 2, 3
+)
+UPDATE station_reliability r
+SET empty_recovery_minutes = recoveries.empty_recovery, full_recovery_minutes = recoveries.full_recovery
+FROM recoveries
+WHERE r.station_id = recoveries.station_id AND r.weekday = recoveries.weekday AND r.hour = recoveries.hour`
+
+func computeReliability() error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+
+	since := time.Now().Add(-reliabilityWindow)
+	_, err = tx.Exec("DELETE FROM station_reliability")
+	if err != nil {
+		return errors.Join(err, tx.Rollback())
+	}
+	_, err = tx.Exec(reliabilitySharesQuery, since)
+	if err != nil {
+		return errors.Join(err, tx.Rollback())
+	}
+	_, err = tx.Exec(reliabilityRecoveryQuery, since)
+	if err != nil {
+		return errors.Join(err, tx.Rollback())
+	}
+
+	return tx.Commit()
+}
+
+func computeReliabilityPeriodically() {
+	ticker := time.NewTicker(reliabilityInterval)
+	defer ticker.Stop()
+	for {
+		err := computeReliability()
+		if err != nil {
+			log.Print(err)
+		}
+		<-ticker.C
+	}
+}
+
+// networkLocation is loaded once at startup.
+var networkLocation *time.Location
+
+func loadNetworkLocation() error {
+	location, err := time.LoadLocation(networkTimeZone)
+	if err != nil {
+		return err
+	}
+	networkLocation = location
+	return nil
+}
+
+// reliabilitySlot returns the weekday and hour a time falls in.
+func reliabilitySlot(t time.Time) (int, int) {
+	t = t.In(networkLocation)
+
+	weekday := int(t.Weekday())
+	if weekday == 0 {
+		weekday = 7
+	}
+	return weekday, t.Hour()
+}
+
+// slotReliabilities returns the reliability of every station for the slot
+// t falls in.
+func slotReliabilities(t time.Time) (map[int]SlotReliability, error) {
+	weekday, hour := reliabilitySlot(t)
+	rows, err := db.Query("SELECT station_id, samples, empty_share, full_share, empty_recovery_minutes, full_recovery_minutes FROM station_reliability WHERE weekday = $1 AND hour = $2", weekday, hour)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	reliabilities := map[int]SlotReliability{}
+	for rows.Next() {
+		var id int
+		slot := SlotReliability{Weekday: weekday, Hour: hour}
+		err := rows.Scan(&id, &slot.Samples, &slot.EmptyShare, &slot.FullShare, &slot.EmptyRecoveryMinutes, &slot.FullRecoveryMinutes)
+		if err != nil {
+			return nil, err
+		}
+		reliabilities[id] = slot
+	}
+
+	return reliabilities, rows.Err()
+}
+
+// stationReliability returns the reliability of a station per slot, along
+// with sample weighted overall figures.
+func stationReliability(stationId int) (StationReliability, error) {
+	result := StationReliability{StationId: stationId, ByHour: []SlotReliability{}}
+	rows, err := db.Query("SELECT weekday, hour, samples, empty_share, full_share, empty_recovery_minutes, full_recovery_minutes FROM station_reliability WHERE station_id = $1 ORDER BY weekday, hour", stationId)
+	if err != nil {
+		return result, err
+	}
+	defer rows.Close()
+
+	var emptyRecovery, fullRecovery, emptyWeight, fullWeight float64
+	for rows.Next() {
+		var slot SlotReliability
+		err := rows.Scan(&slot.Weekday, &slot.Hour, &slot.Samples, &slot.EmptyShare, &slot.FullShare, &slot.EmptyRecoveryMinutes, &slot.FullRecoveryMinutes)
+		if err != nil {
+			return result, err
+		}
+		result.ByHour = append(result.ByHour, slot)
+
+		samples := float64(slot.Samples)
+		result.Samples += slot.Samples
+		result.EmptyShare += slot.EmptyShare * samples
+		result.FullShare += slot.FullShare * samples
+		if slot.EmptyRecoveryMinutes != nil {
+			emptyRecovery += *slot.EmptyRecoveryMinutes * samples
+			emptyWeight += samples
+		}
+		if slot.FullRecoveryMinutes != nil {
+			fullRecovery += *slot.FullRecoveryMinutes * samples
+			fullWeight += samples
+		}
+	}
+	if rows.Err() != nil {
+		return result, rows.Err()
+	}
+
+	if result.Samples > 0 {
+		result.EmptyShare /= float64(result.Samples)
+		result.FullShare /= float64(result.Samples)
+	}
+	if emptyWeight > 0 {
+		minutes := emptyRecovery / emptyWeight
+		result.EmptyRecoveryMinutes = &minutes
+	}
+	if fullWeight > 0 {
+		minutes := fullRecovery / fullWeight
+		result.FullRecoveryMinutes = &minutes
+	}
+
+	return result, nil
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"log"
+	"math"
+	"os"
+	"slices"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// meters per second
+	walkingSpeed = 1.3
+	// a route can be this much longer than the straight line before we
+	// stop looking for it
+	maxDetour = 2.0
+	// typical ratio of street to straight line distances, for estimates
+	// without a graph
+	straightDetour = 1.3
+)
+
+// walkingGraph is set once the extract named by VELIB_OSM_FILE is loaded.
+// Until then, or without extract, distances are straight lines.
+var walkingGraph atomic.Pointer[walkGraph]
+
+func loadWalkingGraph() {
+	path := os.Getenv("VELIB_OSM_FILE")
+	if path == "" {
+		return
+	}
+
+	started := time.Now()
+	g, err := loadWalkGraph(path)
+	if err != nil {
+		log.Print(err)
+		return
+	}
+	walkingGraph.Store(g)
+	log.Printf("loaded walking graph of %d nodes from %s in %s", g.Nodes(), path, time.Since(started).Round(time.Second))
+}
+
+func walkingSeconds(meters float64) int {
+	return int(math.Round(meters / walkingSpeed))
+}
+
+// walkToStations replaces the straight line distances of stations by
+// walking distances from a point and sorts them accordingly, dropping those
+// further than radius meters on foot. Stations which cannot be routed to
+// keep their straight line distance.
+func walkToStations(lat, lon float64, stations []Station, radius int) []Station {
+	g := walkingGraph.Load()
+	if g == nil || len(stations) == 0 {
+		return stations
+	}
+
+	from, fromSnap, ok := g.Snap(lat, lon)
+	if !ok {
+		return stations
+	}
+
+	maxStraight := 0
+	for _, station := range stations {
+		maxStraight = max(maxStraight, station.Distance)
+	}
+	distances := g.DistancesFrom(from, float64(maxStraight)*maxDetour+maxSnapDistance)
+
+	for i, station := range stations {
+		to, toSnap, ok := g.Snap(station.Lat, station.Lon)
+		if !ok {
+			continue
+		}
+		length, ok := distances[to]
+		if !ok {
+			continue
+		}
+
+		meters := fromSnap + length + toSnap
+		stations[i].StraightDistance = station.Distance
+		stations[i].Distance = int(meters)
+		stations[i].WalkingSeconds = walkingSeconds(meters)
+	}
+	stations = slices.DeleteFunc(stations, func(station Station) bool { return station.Distance > radius })
+	slices.SortStableFunc(stations, func(a Station, b Station) int { return a.Distance - b.Distance })
+	return stations
+}
+
+type latLon struct {
+	Lat, Lon float64
+}
+
+// routeDistances returns the distance along the graph from a point to each
+// target, with one search, falling back to the straight line distance
+// times straightDetour for targets which cannot be routed.
+func routeDistances(from latLon, targets []latLon) []float64 {
+	distances := make([]float64, len(targets))
+	maxStraight := 0.0
+	for i, target := range targets {
+		distances[i] = distanceMeters(from.Lat, from.Lon, target.Lat, target.Lon)
+		maxStraight = max(maxStraight, distances[i])
+	}
+
+	g := walkingGraph.Load()
+	var fromNode int32
+	var fromSnap float64
+	routable := g != nil
+	if routable {
+		fromNode, fromSnap, routable = g.Snap(from.Lat, from.Lon)
+	}
+	if !routable {
+		for i := range distances {
+			distances[i] *= straightDetour
+		}
+		return distances
+	}
+
+	reached := g.DistancesFrom(fromNode, maxStraight*maxDetour+maxSnapDistance)
+	for i, target := range targets {
+		to, toSnap, ok := g.Snap(target.Lat, target.Lon)
+		length, reachable := reached[to]
+		if ok && reachable {
+			distances[i] = fromSnap + length + toSnap
+		} else {
+			distances[i] *= straightDetour
+		}
+	}
+	return distances
+}
@@ -5,13 +5,56 @@ import (
 )
 
 type Station struct {
-	Id        int
-	StationId int `json:"station_id"`
-	Name      string
-	Lat       float64
-	Lon       float64
-	BikeCount int `json:"numBikesAvailable"`
-	DockCount int `json:"numDocksAvailable"`
-	Distance  int
-	UpdateAt  time.Time
+	Id         int
+	StationId  int `json:"station_id"`
+	Name       string
+	Lat        float64
+	Lon        float64
+	Capacity   int `json:"capacity"`
+	BikeCount  int `json:"numBikesAvailable"`
+	EBikeCount int `json:"numEBikesAvailable"`
+	DockCount  int `json:"numDocksAvailable"`
+	Distance   int
+	// when Distance is a walking distance, the straight line one and the
+	// time to walk it
+	StraightDistance int `json:",omitempty"`
+	WalkingSeconds   int `json:",omitempty"`
+	UpdateAt         time.Time
+	// for the current weekday and hour, when asked for
+	Reliability *SlotReliability `json:",omitempty"`
+	Trend       *StationTrend    `json:",omitempty"`
+	// only when ranking stations
+	Score *ScoreBreakdown `json:",omitempty"`
+
+	// active alerts concerning the station, when asked for
+	Alerts []Alert `json:",omitempty"`
+
+	// only filled when decoding station_status.json
+	BikeTypes []map[string]int `json:"num_bikes_available_types,omitempty"`
+	// only filled when decoding station_information.json
+	RegionId gbfsId `json:"region_id,omitempty"`
+}
+
+func (s Station) MechanicalCount() int {
+	return s.BikeCount - s.EBikeCount
+}
+
+// Available returns the count a watch or ranking refers to by kind: bikes,
+// ebikes, mechanical or docks.
+func (s Station) Available(kind string) int {
+	switch kind {
+	case "bikes":
+		return s.BikeCount
+	case "ebikes":
+		return s.EBikeCount
+	case "mechanical":
+		return s.MechanicalCount()
+	case "docks":
+		return s.DockCount
+	}
+	return 0
+}
+
+func validAvailabilityKind(kind string) bool {
+	return kind == "bikes" || kind == "ebikes" || kind == "mechanical" || kind == "docks"
 }
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"html/template"
+	"log"
+	"net/http"
+	"strconv"
+)
+
+type StationPageController struct{}
+
+func (c *StationPageController) Show(w http.ResponseWriter, r *http.Request) {
+	stationId, err := strconv.Atoi(r.PathValue("station_id"))
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	at, err := parseAt(r.URL.Query())
+	if err != nil {
+		defer handleHttpBadRequest(w, err)
+		return
+	}
+
+	detail, err := findStationDetail(stationId, at)
+	if errors.Is(err, sql.ErrNoRows) {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		defer handleHttpError(w, err)
+		return
+	}
+
+	tmpl, err := template.ParseFiles("station.html")
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError),
+			http.StatusInternalServerError)
+		log.Print(err)
+		return
+	}
+
+	err = tmpl.Execute(w, detail)
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError),
+			http.StatusInternalServerError)
+		log.Print(err)
+		return
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"math"
+	"slices"
+	"sync"
+)
+
+const (
+	// matches scoring less are not worth returning
+	minStationSearchScore = 0.3
+	// with a location, a station this far loses distancePenalty from its
+	// score, closer ones proportionally less
+	searchDistanceScale = 5000
+	distancePenalty     = 0.2
+)
+
+type StationMatch struct {
+	Station
+	// how well the name matches, 1 being an exact match
+	MatchScore float64
+}
+
+// stationNames indexes the names of the stations of a snapshot, rebuilt
+// when a refresh publishes a new one.
+type stationNames struct {
+	snapshot *StationsSnapshot
+	index    *trigramIndex
+	ids      []int
+}
+
+var (
+	stationNamesMu sync.Mutex
+	stationNamesOf stationNames
+)
+
+func stationNameIndex(snapshot *StationsSnapshot) stationNames {
+	stationNamesMu.Lock()
+	defer stationNamesMu.Unlock()
+	if stationNamesOf.snapshot == snapshot {
+		return stationNamesOf
+	}
+
+	names := stationNames{snapshot: snapshot, index: newTrigramIndex()}
+	for id, station := range snapshot.Stations {
+		names.index.Add(foldStreet(station.Name))
+		names.ids = append(names.ids, id)
+	}
+	stationNamesOf = names
+	return names
+}
+
+// searchStations returns the stations whose name best matches a query,
+// accents, case and typos aside. With partial, the last word of the query
+// is taken as a prefix. With a location, closer stations rank higher and
+// get their distance.
+func searchStations(query string, partial bool, location *latLon, limit int) []StationMatch {
+	snapshot := stationUpdates.Latest()
+	if snapshot == nil {
+		return []StationMatch{}
+	}
+	names := stationNameIndex(snapshot)
+
+	matches := []StationMatch{}
+	for _, match := range names.index.Search(foldStreet(query), partial, minStationSearchScore) {
+		station := snapshot.Stations[names.ids[match.Doc]]
+		matches = append(matches, StationMatch{Station: station, MatchScore: math.Round(match.Score*1000) / 1000})
+	}
+
+	rank := func(m StationMatch) float64 { return m.MatchScore }
+	if location != nil {
+		for i, match := range matches {
+			matches[i].Distance = Haversine(location.Lat, location.Lon, match.Lat, match.Lon)
+		}
+		rank = func(m StationMatch) float64 {
+			return m.MatchScore - distancePenalty*math.Min(float64(m.Distance)/searchDistanceScale, 1)
+		}
+	}
+	slices.SortStableFunc(matches, func(a StationMatch, b StationMatch) int {
+		if rank(a) > rank(b) {
+			return -1
+		}
+		if rank(a) < rank(b) {
+			return 1
+		}
+		return a.StationId - b.StationId
+	})
+
+	if len(matches) > limit {
+		matches = matches[:limit]
+	}
+	return matches
+}
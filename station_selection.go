@@ -0,0 +1,148 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+const maxSelectedStations = 200
+
+type stationArea struct {
+	Latitude  float64 `json:"latitude"`
+	Longitude float64 `json:"longitude"`
+	// in any format parseLocation reads, instead of latitude and longitude
+	Location string `json:"location,omitempty"`
+	Radius   int    `json:"radius"`
+}
+
+// resolve replaces Location by the latitude and longitude it stands for.
+func (a *stationArea) resolve() error {
+	if a.Location == "" {
+		return nil
+	}
+
+	location, err := parseLocation(a.Location)
+	if err != nil {
+		return err
+	}
+	a.Latitude, a.Longitude, a.Location = location.Lat, location.Lon, ""
+	return nil
+}
+
+// stationSelection is the set of stations a live client follows, either
+// by id or by area.
+type stationSelection struct {
+	StationIds map[int]bool
+	Areas      []stationArea
+}
+
+func (s stationSelection) Matches(station Station) bool {
+	if s.StationIds[station.StationId] {
+		return true
+	}
+	for _, area := range s.Areas {
+		if Haversine(area.Latitude, area.Longitude, station.Lat, station.Lon) <= area.Radius {
+			return true
+		}
+	}
+	return false
+}
+
+func (s stationSelection) Empty() bool {
+	return len(s.StationIds) == 0 && len(s.Areas) == 0
+}
+
+// parseStationIds reads a comma separated list of station ids.
+func parseStationIds(s string) ([]int, error) {
+	var ids []int
+	for _, part := range strings.Split(s, ",") {
+		if strings.TrimSpace(part) == "" {
+			continue
+		}
+		id, err := strconv.Atoi(strings.TrimSpace(part))
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+
+	if len(ids) > maxSelectedStations {
+		return nil, errors.New(fmt.Sprintf("at most %d stations can be selected", maxSelectedStations))
+	}
+
+	return ids, nil
+}
+
+// parseStationSelection reads either station_ids or a location and an
+// optional radius from the query.
+func parseStationSelection(params url.Values) (stationSelection, error) {
+	selection := stationSelection{StationIds: map[int]bool{}}
+
+	ids, err := parseStationIds(params.Get("station_ids"))
+	if err != nil {
+		return selection, err
+	}
+	for _, id := range ids {
+		selection.StationIds[id] = true
+	}
+
+	if hasLocationParams(params) {
+		location, err := parseLocationParams(params)
+		if err != nil {
+			return selection, err
+		}
+
+		radius, err := optionalInt(params, "radius", defaultClosestRadius)
+		if err != nil {
+			return selection, err
+		}
+
+		selection.Areas = append(selection.Areas, stationArea{Latitude: location.Lat, Longitude: location.Lon, Radius: min(max(radius, 0), maxClosestRadius)})
+	}
+
+	if selection.Empty() {
+		return selection, errors.New("station_ids or a location are required")
+	}
+
+	return selection, nil
+}
+
+type StationsDiff struct {
+	Stations []Station
+	// stations no longer part of the network
+	Removed []int
+}
+
+// diffSelection compares the selected stations of a snapshot with what was
+// last sent to a client, updating sent along the way.
+func diffSelection(selection stationSelection, snapshot *StationsSnapshot, sent map[int]Station) StationsDiff {
+	diff := StationsDiff{Stations: []Station{}, Removed: []int{}}
+	for id, station := range snapshot.Stations {
+		if !selection.Matches(station) {
+			continue
+		}
+		previous, ok := sent[id]
+		if ok && sameAvailability(previous, station) {
+			continue
+		}
+		sent[id] = station
+		diff.Stations = append(diff.Stations, station)
+	}
+
+	for id := range sent {
+		station, ok := snapshot.Stations[id]
+		if !ok {
+			delete(sent, id)
+			diff.Removed = append(diff.Removed, id)
+		} else if !selection.Matches(station) {
+			// no longer followed, forget it so it is sent in full if
+			// selected again
+			delete(sent, id)
+		}
+	}
+
+	return diff
+}
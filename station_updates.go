@@ -0,0 +1,84 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// StationsSnapshot is the state of the whole network after a refresh.
+type StationsSnapshot struct {
+	// unix time of the refresh, used as event id by the streaming endpoints
+	Id       int64
+	At       time.Time
+	Stations map[int]Station
+}
+
+// stationHub fans each refresh out to the live connections. Subscribers
+// get a channel holding at most the latest snapshot, so a slow consumer
+// skips intermediate refreshes instead of blocking the others; consumers
+// diff against what they last sent rather than relying on every snapshot.
+type stationHub struct {
+	mu          sync.Mutex
+	subscribers map[chan *StationsSnapshot]struct{}
+	latest      *StationsSnapshot
+}
+
+var stationUpdates = stationHub{subscribers: map[chan *StationsSnapshot]struct{}{}}
+
+func (h *stationHub) Subscribe() (chan *StationsSnapshot, *StationsSnapshot) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	ch := make(chan *StationsSnapshot, 1)
+	h.subscribers[ch] = struct{}{}
+	return ch, h.latest
+}
+
+func (h *stationHub) Unsubscribe(ch chan *StationsSnapshot) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.subscribers, ch)
+}
+
+func (h *stationHub) Latest() *StationsSnapshot {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.latest
+}
+
+func (h *stationHub) Publish(snapshot *StationsSnapshot) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.latest = snapshot
+	for ch := range h.subscribers {
+		select {
+		case <-ch:
+		default:
+		}
+		ch <- snapshot
+	}
+}
+
+// publishStations loads the current stations and hands them to subscribers.
+func publishStations() (*StationsSnapshot, error) {
+	stations, err := stationsInBBox(BBox{West: -180, South: -90, East: 180, North: 90})
+	if err != nil {
+		return nil, err
+	}
+
+	snapshot := &StationsSnapshot{Stations: map[int]Station{}}
+	for _, station := range stations {
+		snapshot.Stations[station.StationId] = station
+		if station.UpdateAt.After(snapshot.At) {
+			snapshot.At = station.UpdateAt
+		}
+	}
+	snapshot.Id = snapshot.At.Unix()
+
+	stationUpdates.Publish(snapshot)
+	return snapshot, nil
+}
+
+// sameAvailability reports whether nothing a client displays changed.
+func sameAvailability(a, b Station) bool {
+	return a.BikeCount == b.BikeCount && a.EBikeCount == b.EBikeCount && a.DockCount == b.DockCount && a.Capacity == b.Capacity
+}
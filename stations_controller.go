@@ -1,57 +1,566 @@
 package main
 
 import (
+	"database/sql"
 	"encoding/json"
+	"errors"
 	"net/http"
 	"slices"
 	"strconv"
+	"time"
 )
 
 type StationsController struct{}
 
+const (
+	defaultClosestRadius = 2000
+	maxClosestRadius     = 20000
+	defaultClosestLimit  = 5
+	maxClosestLimit      = 50
+	// meters added to the distance of a station always empty, or full,
+	// when down-ranking unreliable stations
+	unreliablePenalty = 1000
+	// a location further than this from any station is outside the service
+	// area
+	serviceAreaMargin = 2000
+)
+
+type ClosestStations struct {
+	// number of stations within the radius, before applying the limit
+	Total              int
+	OutsideServiceArea bool
+	Stations           []Station
+	// set when no location was given and the client's IP address was
+	// used instead
+	ApproximateLocation *GeoIpLocation `json:",omitempty"`
+}
+
+// stationsWithin returns the stations with bikes or docks available within
+// radius meters, sorted by walking distance when a walking graph is loaded,
+// live or at a past time.
+func stationsWithin(latitude, longitude float64, radius int, at time.Time) ([]Station, error) {
+	candidates, err := stationsInBBoxAt(RadiusBBox(latitude, longitude, radius), at)
+	if err != nil {
+		return nil, err
+	}
+
+	stations := []Station{}
+	for _, station := range candidates {
+		if station.DockCount == 0 && station.BikeCount == 0 {
+			continue
+		}
+
+		station.Distance = Haversine(latitude, longitude, station.Lat, station.Lon)
+		if station.Distance <= radius {
+			stations = append(stations, station)
+		}
+	}
+	slices.SortFunc(stations, func(a Station, b Station) int { return a.Distance - b.Distance })
+	stations = walkToStations(latitude, longitude, stations, radius)
+
+	return stations, nil
+}
+
+// downRankUnreliable sorts stations by distance plus a penalty growing with
+// how often they are empty, or full, in the slot of at.
+func downRankUnreliable(stations []Station, avoid string, at time.Time) error {
+	if at.IsZero() {
+		at = time.Now()
+	}
+	reliabilities, err := slotReliabilities(at)
+	if err != nil {
+		return err
+	}
+
+	penalties := map[int]int{}
+	for i, station := range stations {
+		reliability, ok := reliabilities[station.StationId]
+		if !ok {
+			continue
+		}
+		stations[i].Reliability = &reliability
+
+		share := reliability.EmptyShare
+		if avoid == "docks" {
+			share = reliability.FullShare
+		}
+		penalties[station.StationId] = int(share * unreliablePenalty)
+	}
+	slices.SortStableFunc(stations, func(a Station, b Station) int {
+		return a.Distance + penalties[a.StationId] - b.Distance - penalties[b.StationId]
+	})
+
+	return nil
+}
+
+// outsideServiceArea tells whether a location is far from every station of
+// the network, rather than only from those within the requested radius.
+func outsideServiceArea(location latLon) bool {
+	snapshot := stationUpdates.Latest()
+	if snapshot == nil || len(snapshot.Stations) == 0 {
+		return false
+	}
+
+	for _, station := range snapshot.Stations {
+		if Haversine(location.Lat, location.Lon, station.Lat, station.Lon) <= serviceAreaMargin {
+			return false
+		}
+	}
+	return true
+}
+
+// closestStations answers the closest stations queries, writing the error
+// response itself when it fails.
+func closestStations(w http.ResponseWriter, r *http.Request) (ClosestStations, bool) {
+	params := r.URL.Query()
+	var approximate *GeoIpLocation
+	location, err := parseLocationParams(params)
+	if err != nil && !hasLocationParams(params) {
+		var ok bool
+		approximate, ok = locateClient(r)
+		if ok {
+			location, err = latLon{Lat: approximate.Lat, Lon: approximate.Lon}, nil
+		}
+	}
+	if err != nil {
+		handleHttpBadRequest(w, err)
+		return ClosestStations{}, false
+	}
+
+	radius, err := optionalInt(params, "radius", defaultClosestRadius)
+	if err != nil {
+		handleHttpBadRequest(w, err)
+		return ClosestStations{}, false
+	}
+	radius = min(max(radius, 0), maxClosestRadius)
+
+	limit, err := optionalInt(params, "limit", defaultClosestLimit)
+	if err != nil {
+		handleHttpBadRequest(w, err)
+		return ClosestStations{}, false
+	}
+	limit = min(max(limit, 1), maxClosestLimit)
+
+	at, err := parseAt(params)
+	if err != nil {
+		handleHttpBadRequest(w, err)
+		return ClosestStations{}, false
+	}
+
+	stations, err := stationsWithin(location.Lat, location.Lon, radius, at)
+	if err != nil {
+		handleHttpError(w, err)
+		return ClosestStations{}, false
+	}
+
+	// need=bikes or need=docks ranks stations with the ranking engine,
+	// weights being overridable with the weights parameter. Reliability
+	// being one of its criteria, it cannot be combined with
+	// avoid_unreliable.
+	need := params.Get("need")
+	avoid := params.Get("avoid_unreliable")
+	if need != "" && avoid != "" {
+		handleHttpBadRequest(w, errors.New("need and avoid_unreliable cannot both be given, use the reliability weight instead"))
+		return ClosestStations{}, false
+	}
+	if need != "" {
+		if need != "bikes" && need != "docks" {
+			handleHttpBadRequest(w, errors.New("need must be bikes or docks"))
+			return ClosestStations{}, false
+		}
+
+		weights, err := ParseRankingWeights(params.Get("weights"), defaultRankingWeights)
+		if err != nil {
+			handleHttpBadRequest(w, err)
+			return ClosestStations{}, false
+		}
+
+		err = rankStations(stations, need, radius, weights, at)
+		if err != nil {
+			handleHttpError(w, err)
+			return ClosestStations{}, false
+		}
+	}
+
+	// avoid_unreliable=bikes ranks stations often empty at this time of
+	// the week lower, avoid_unreliable=docks those often full
+	if avoid != "" {
+		if avoid != "bikes" && avoid != "docks" {
+			handleHttpBadRequest(w, errors.New("avoid_unreliable must be bikes or docks"))
+			return ClosestStations{}, false
+		}
+
+		err = downRankUnreliable(stations, avoid, at)
+		if err != nil {
+			handleHttpError(w, err)
+			return ClosestStations{}, false
+		}
+	}
+
+	result := ClosestStations{Total: len(stations), OutsideServiceArea: len(stations) == 0 && outsideServiceArea(location), Stations: stations, ApproximateLocation: approximate}
+	if len(stations) > limit {
+		result.Stations = stations[:limit]
+	}
+
+	err = withTrends(result.Stations, at)
+	if err != nil {
+		handleHttpError(w, err)
+		return ClosestStations{}, false
+	}
+
+	err = withAlerts(result.Stations, at)
+	if err != nil {
+		handleHttpError(w, err)
+		return ClosestStations{}, false
+	}
+
+	return result, true
+}
+
+// ListClosest returns the closest stations as a plain array, as it always
+// has.
 func (s StationsController) ListClosest(w http.ResponseWriter, r *http.Request) {
-	rows, err := db.Query("SELECT name, lat, lon, dock_count, bike_count FROM stations WHERE dock_count > 0 OR bike_count > 0")
+	result, ok := closestStations(w, r)
+	if !ok {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(result.Stations)
 	if err != nil {
 		defer handleHttpError(w, err)
 		return
 	}
+}
 
-	var stations []Station
+// ListClosestDetails returns the closest stations along with their total
+// and whether the location is outside the service area.
+func (s StationsController) ListClosestDetails(w http.ResponseWriter, r *http.Request) {
+	result, ok := closestStations(w, r)
+	if !ok {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(result)
+	if err != nil {
+		defer handleHttpError(w, err)
+		return
+	}
+}
+
+const stationHistoryWindow = 24 * time.Hour
+
+const (
+	// addresses shown as close to a station
+	stationAddressRadius = 150
+	stationAddresses     = 3
+)
+
+type StationDetail struct {
+	Station
+	History []StationSnapshot
+	// closest addresses, when the geocoder is loaded
+	Addresses []Address `json:",omitempty"`
+}
+
+func findStation(stationId int) (Station, error) {
+	var station Station
+	err := db.QueryRow("SELECT id, station_id, name, lat, lon, capacity, bike_count, ebike_count, dock_count, updated_at FROM stations WHERE station_id = $1", stationId).
+		Scan(&station.Id, &station.StationId, &station.Name, &station.Lat, &station.Lon, &station.Capacity, &station.BikeCount, &station.EBikeCount, &station.DockCount, &station.UpdateAt)
+	return station, err
+}
+
+// findStationDetail loads a station along with its snapshots over the
+// stationHistoryWindow before at, or before now when at is zero. It returns
+// sql.ErrNoRows for unknown stations.
+func findStationDetail(stationId int, at time.Time) (StationDetail, error) {
+	station, err := findStationAt(stationId, at)
+	if err != nil {
+		return StationDetail{}, err
+	}
+
+	until := at
+	if until.IsZero() {
+		until = time.Now()
+	}
+	history, err := stationHistory(stationId, until.Add(-stationHistoryWindow), until)
+	if err != nil {
+		return StationDetail{}, err
+	}
+
+	var recent []StationSnapshot
+	for _, snapshot := range history {
+		if snapshot.RecordedAt.After(until.Add(-trendWindow)) {
+			recent = append(recent, snapshot)
+		}
+	}
+	if len(recent) >= minTrendSamples {
+		trend := computeTrend(recent)
+		station.Trend = &trend
+	}
+
+	detail := StationDetail{Station: station, History: history}
+	if g := addressGeocoder.Load(); g != nil {
+		detail.Addresses = g.Reverse(latLon{Lat: station.Lat, Lon: station.Lon}, stationAddressRadius, stationAddresses)
+	}
+
+	return detail, nil
+}
+
+func (s StationsController) Show(w http.ResponseWriter, r *http.Request) {
+	stationId, err := strconv.Atoi(r.PathValue("station_id"))
+	if err != nil {
+		defer handleHttpBadRequest(w, err)
+		return
+	}
+
+	at, err := parseAt(r.URL.Query())
+	if err != nil {
+		defer handleHttpBadRequest(w, err)
+		return
+	}
+
+	detail, err := findStationDetail(stationId, at)
+	if errors.Is(err, sql.ErrNoRows) {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		defer handleHttpError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(detail)
+	if err != nil {
+		defer handleHttpError(w, err)
+		return
+	}
+}
+
+// HistoryChanges returns the snapshots whose counts differ from the previous
+// one, newest first, so the station page doesn't list every refresh.
+func (d StationDetail) HistoryChanges() []StationSnapshot {
+	var changes []StationSnapshot
+	for i, snapshot := range d.History {
+		if i > 0 {
+			previous := d.History[i-1]
+			if snapshot.BikeCount == previous.BikeCount && snapshot.EBikeCount == previous.EBikeCount && snapshot.DockCount == previous.DockCount {
+				continue
+			}
+		}
+		changes = append(changes, snapshot)
+	}
+	slices.Reverse(changes)
+
+	return changes
+}
+
+const (
+	maxBBoxStations = 2000
+	// below this zoom a viewport covers most of the network, so unless told
+	// otherwise only the stations closest to its center are returned
+	bboxDetailZoom         = 14
+	defaultBBoxLowZoomSize = 300
+)
+
+type StationsInBBox struct {
+	Total     int
+	Truncated bool
+	Stations  []Station
+	Clusters  []StationCluster `json:",omitempty"`
+}
+
+func stationsInBBox(bbox BBox) ([]Station, error) {
+	rows, err := db.Query("SELECT station_id, name, lat, lon, capacity, dock_count, bike_count, ebike_count, updated_at FROM stations WHERE lat BETWEEN $1 AND $2 AND lon BETWEEN $3 AND $4", bbox.South, bbox.North, bbox.West, bbox.East)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	stations := []Station{}
 	for rows.Next() {
 		var station Station
-		err := rows.Scan(&station.Name, &station.Lat, &station.Lon, &station.DockCount, &station.BikeCount)
+		err := rows.Scan(&station.StationId, &station.Name, &station.Lat, &station.Lon, &station.Capacity, &station.DockCount, &station.BikeCount, &station.EBikeCount, &station.UpdateAt)
 		if err != nil {
-			defer handleHttpError(w, err)
-			return
+			return nil, err
 		}
 
 		stations = append(stations, station)
 	}
 
+	return stations, rows.Err()
+}
+
+func (s StationsController) ListInBBox(w http.ResponseWriter, r *http.Request) {
 	params := r.URL.Query()
-	latitude, err := strconv.ParseFloat(params.Get("latitude"), 64)
+	bbox, err := ParseBBox(params.Get("bbox"))
 	if err != nil {
-		defer handleHttpError(w, err)
+		defer handleHttpBadRequest(w, err)
 		return
 	}
 
-	longitude, err := strconv.ParseFloat(params.Get("longitude"), 64)
+	zoom, err := optionalInt(params, "zoom", bboxDetailZoom)
+	if err != nil {
+		defer handleHttpBadRequest(w, err)
+		return
+	}
+	zoom = min(max(zoom, 0), 22)
+
+	// clustering is on by default for zooms showing most of the network
+	cluster := zoom < bboxDetailZoom
+	switch params.Get("cluster") {
+	case "":
+	case "grid":
+		cluster = true
+	case "none":
+		cluster = false
+	default:
+		defer handleHttpBadRequest(w, errors.New("cluster must be grid or none"))
+		return
+	}
+
+	limit := maxBBoxStations
+	if zoom < bboxDetailZoom {
+		limit = defaultBBoxLowZoomSize
+	}
+	limit, err = optionalInt(params, "limit", limit)
+	if err != nil {
+		defer handleHttpBadRequest(w, err)
+		return
+	}
+	limit = min(max(limit, 1), maxBBoxStations)
+
+	at, err := parseAt(params)
+	if err != nil {
+		defer handleHttpBadRequest(w, err)
+		return
+	}
+
+	stations, err := stationsInBBoxAt(bbox, at)
 	if err != nil {
 		defer handleHttpError(w, err)
 		return
 	}
 
+	if cluster {
+		w.Header().Set("Content-Type", "application/json")
+		err = json.NewEncoder(w).Encode(StationsInBBox{Total: len(stations), Stations: []Station{}, Clusters: ClusterStations(stations, zoom)})
+		if err != nil {
+			defer handleHttpError(w, err)
+		}
+		return
+	}
+
+	latitude, longitude := bbox.Center()
 	for i, station := range stations {
 		stations[i].Distance = Haversine(latitude, longitude, station.Lat, station.Lon)
 	}
 	slices.SortFunc(stations, func(a Station, b Station) int { return a.Distance - b.Distance })
 
-	if len(stations) >= 5 {
-		stations = stations[:5]
+	result := StationsInBBox{Total: len(stations), Stations: stations}
+	if len(stations) > limit {
+		result.Stations = stations[:limit]
+		result.Truncated = true
+	}
+
+	err = withTrends(result.Stations, at)
+	if err != nil {
+		defer handleHttpError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(result)
+	if err != nil {
+		defer handleHttpError(w, err)
+		return
+	}
+}
+
+func (s StationsController) ListChanges(w http.ResponseWriter, r *http.Request) {
+	since, err := strconv.ParseInt(r.URL.Query().Get("since"), 10, 64)
+	if err != nil {
+		defer handleHttpBadRequest(w, err)
+		return
+	}
+
+	changes, err := changesSince(since)
+	if err != nil {
+		defer handleHttpError(w, err)
+		return
 	}
 
 	w.Header().Set("Content-Type", "application/json")
-	err = json.NewEncoder(w).Encode(stations)
+	err = json.NewEncoder(w).Encode(changes)
+	if err != nil {
+		defer handleHttpError(w, err)
+		return
+	}
+}
+
+func (s StationsController) ShowReliability(w http.ResponseWriter, r *http.Request) {
+	stationId, err := strconv.Atoi(r.PathValue("station_id"))
+	if err != nil {
+		defer handleHttpBadRequest(w, err)
+		return
+	}
+
+	reliability, err := stationReliability(stationId)
+	if err != nil {
+		defer handleHttpError(w, err)
+		return
+	}
+	if len(reliability.ByHour) == 0 {
+		http.NotFound(w, r)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(reliability)
+	if err != nil {
+		defer handleHttpError(w, err)
+		return
+	}
+}
+
+const (
+	defaultSearchLimit = 10
+	maxSearchLimit     = 50
+)
+
+// Search finds stations by name, with autocomplete=true completing the
+// last word of q, and with a location ranking closer stations higher.
+func (s StationsController) Search(w http.ResponseWriter, r *http.Request) {
+	params := r.URL.Query()
+	query := params.Get("q")
+	if query == "" {
+		defer handleHttpBadRequest(w, errors.New("q is required"))
+		return
+	}
+
+	limit, err := optionalInt(params, "limit", defaultSearchLimit)
+	if err != nil {
+		defer handleHttpBadRequest(w, err)
+		return
+	}
+	limit = min(max(limit, 1), maxSearchLimit)
+
+	var location *latLon
+	if hasLocationParams(params) {
+		l, err := parseLocationParams(params)
+		if err != nil {
+			defer handleHttpBadRequest(w, err)
+			return
+		}
+		location = &l
+	}
+
+	matches := searchStations(query, params.Get("autocomplete") == "true", location, limit)
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(matches)
 	if err != nil {
 		defer handleHttpError(w, err)
 		return
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const sseHeartbeat = 15 * time.Second
+
+type StreamController struct{}
+
+// Stream pushes availability changes of the selected stations as
+// Server-Sent Events after each refresh.
+func (c *StreamController) Stream(w http.ResponseWriter, r *http.Request) {
+	selection, err := parseStationSelection(r.URL.Query())
+	if err != nil {
+		defer handleHttpBadRequest(w, err)
+		return
+	}
+
+	updates, latest := stationUpdates.Subscribe()
+	defer stationUpdates.Unsubscribe(updates)
+
+	sent := map[int]Station{}
+	// a client resuming at the latest refresh already has its state
+	lastEventId, err := strconv.ParseInt(r.Header.Get("Last-Event-ID"), 10, 64)
+	if err == nil && latest != nil && lastEventId == latest.Id {
+		diffSelection(selection, latest, sent)
+		latest = nil
+	}
+
+	rc := http.NewResponseController(w)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	_, err = fmt.Fprint(w, "retry: 5000\n\n")
+	if err != nil {
+		return
+	}
+
+	send := func(snapshot *StationsSnapshot) error {
+		diff := diffSelection(selection, snapshot, sent)
+		if len(diff.Stations) == 0 && len(diff.Removed) == 0 {
+			return nil
+		}
+
+		data, err := json.Marshal(diff)
+		if err != nil {
+			return err
+		}
+
+		_, err = fmt.Fprintf(w, "id: %d\nevent: stations\ndata: %s\n\n", snapshot.Id, data)
+		if err != nil {
+			return err
+		}
+		return rc.Flush()
+	}
+
+	if latest != nil {
+		err = send(latest)
+		if err != nil {
+			return
+		}
+	}
+	err = rc.Flush()
+	if err != nil {
+		return
+	}
+
+	heartbeat := time.NewTicker(sseHeartbeat)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case snapshot := <-updates:
+			err = send(snapshot)
+		case <-heartbeat.C:
+			_, err = fmt.Fprint(w, ": heartbeat\n\n")
+			if err == nil {
+				err = rc.Flush()
+			}
+		}
+		if err != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"sort"
+	"time"
+)
+
+const (
+	maxSubscribedAreas = 10
+	wsPingInterval     = 25 * time.Second
+)
+
+type wsClientMessage struct {
+	Type       string        `json:"type"`
+	StationIds []int         `json:"station_ids"`
+	Areas      []stationArea `json:"areas"`
+	All        bool          `json:"all"`
+}
+
+type wsServerMessage struct {
+	Type       string        `json:"type"`
+	Id         int64         `json:"id,omitempty"`
+	Message    string        `json:"message,omitempty"`
+	StationIds []int         `json:"station_ids,omitempty"`
+	Areas      []stationArea `json:"areas,omitempty"`
+	Stations   []Station     `json:"stations,omitempty"`
+	Removed    []int         `json:"removed,omitempty"`
+}
+
+type SubscriptionsController struct{}
+
+// apply updates the selection with a subscribe or unsubscribe message.
+func (m wsClientMessage) apply(selection *stationSelection) error {
+	for i := range m.Areas {
+		err := m.Areas[i].resolve()
+		if err != nil {
+			return err
+		}
+	}
+
+	switch m.Type {
+	case "subscribe":
+		ids := len(selection.StationIds)
+		for _, id := range m.StationIds {
+			if !selection.StationIds[id] {
+				ids++
+			}
+		}
+		if ids > maxSelectedStations {
+			return errors.New(fmt.Sprintf("at most %d stations can be subscribed to", maxSelectedStations))
+		}
+		if len(selection.Areas)+len(m.Areas) > maxSubscribedAreas {
+			return errors.New(fmt.Sprintf("at most %d areas can be subscribed to", maxSubscribedAreas))
+		}
+		for _, area := range m.Areas {
+			if area.Radius <= 0 || area.Radius > maxClosestRadius {
+				return errors.New(fmt.Sprintf("area radius must be between 1 and %d meters", maxClosestRadius))
+			}
+		}
+
+		for _, id := range m.StationIds {
+			selection.StationIds[id] = true
+		}
+		selection.Areas = append(selection.Areas, m.Areas...)
+	case "unsubscribe":
+		if m.All {
+			selection.StationIds = map[int]bool{}
+			selection.Areas = nil
+			return nil
+		}
+		for _, id := range m.StationIds {
+			delete(selection.StationIds, id)
+		}
+		selection.Areas = slices.DeleteFunc(selection.Areas, func(area stationArea) bool { return slices.Contains(m.Areas, area) })
+	default:
+		return errors.New(fmt.Sprintf("unknown message type: %s", m.Type))
+	}
+
+	return nil
+}
+
+// Connect upgrades to a WebSocket over which clients subscribe to stations
+// by id or area and receive diffs after each refresh. Writes time out on
+// clients not keeping up, and in the meantime refreshes are coalesced.
+func (c *SubscriptionsController) Connect(w http.ResponseWriter, r *http.Request) {
+	conn, err := upgradeWebSocket(w, r)
+	if err != nil {
+		return
+	}
+	defer conn.Close(wsCloseNormal, "")
+
+	updates, _ := stationUpdates.Subscribe()
+	defer stationUpdates.Unsubscribe(updates)
+
+	messages := make(chan wsClientMessage)
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		defer close(messages)
+		for {
+			opcode, payload, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			if opcode != wsText {
+				conn.Close(wsClosePolicy, "only text messages are supported")
+				return
+			}
+
+			var message wsClientMessage
+			err = json.Unmarshal(payload, &message)
+			if err != nil {
+				conn.Close(wsCloseInvalidData, "invalid json")
+				return
+			}
+
+			select {
+			case messages <- message:
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	send := func(message wsServerMessage) error {
+		data, err := json.Marshal(message)
+		if err != nil {
+			return err
+		}
+		return conn.WriteText(data)
+	}
+
+	selection := stationSelection{StationIds: map[int]bool{}}
+	sent := map[int]Station{}
+	sendDiff := func(snapshot *StationsSnapshot) error {
+		if snapshot == nil {
+			return nil
+		}
+		diff := diffSelection(selection, snapshot, sent)
+		if len(diff.Stations) == 0 && len(diff.Removed) == 0 {
+			return nil
+		}
+		return send(wsServerMessage{Type: "diff", Id: snapshot.Id, Stations: diff.Stations, Removed: diff.Removed})
+	}
+
+	ping := time.NewTicker(wsPingInterval)
+	defer ping.Stop()
+	for {
+		select {
+		case message, ok := <-messages:
+			if !ok {
+				return
+			}
+
+			err = message.apply(&selection)
+			if err != nil {
+				err = send(wsServerMessage{Type: "error", Message: err.Error()})
+				break
+			}
+
+			ack := wsServerMessage{Type: "subscriptions", StationIds: []int{}, Areas: selection.Areas}
+			for id := range selection.StationIds {
+				ack.StationIds = append(ack.StationIds, id)
+			}
+			sort.Ints(ack.StationIds)
+			err = send(ack)
+			if err == nil {
+				err = sendDiff(stationUpdates.Latest())
+			}
+		case snapshot := <-updates:
+			err = sendDiff(snapshot)
+		case <-ping.C:
+			err = conn.Ping()
+		}
+		if err != nil {
+			if !errors.Is(err, errWebSocketClosed) {
+				log.Print(err)
+			}
+			return
+		}
+	}
+}
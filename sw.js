@@ -0,0 +1,9 @@
+self.addEventListener("push", (event) => {
+	let notification = event.data.json()
+	event.waitUntil(self.registration.showNotification(notification.title, {body: notification.body, icon: "/files/velib.png", data: notification.url}))
+})
+
+self.addEventListener("notificationclick", (event) => {
+	event.notification.close()
+	event.waitUntil(clients.openWindow(event.notification.data))
+})
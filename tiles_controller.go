@@ -0,0 +1,134 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	maxTileZoom = 22
+	// the cache is dropped wholesale past this many tiles
+	maxCachedTiles = 4096
+)
+
+// tileCache keeps encoded station tiles until the next refresh.
+type tileCache struct {
+	mu    sync.Mutex
+	tiles map[string][]byte
+	// bumped on every invalidation so tiles encoded from older data are
+	// not stored
+	generation int
+}
+
+func (c *tileCache) Get(key string) ([]byte, int, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	tile, ok := c.tiles[key]
+	return tile, c.generation, ok
+}
+
+func (c *tileCache) Put(key string, tile []byte, generation int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if generation != c.generation {
+		return
+	}
+	if c.tiles == nil || len(c.tiles) >= maxCachedTiles {
+		c.tiles = map[string][]byte{}
+	}
+	c.tiles[key] = tile
+}
+
+func (c *tileCache) Invalidate() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.tiles = nil
+	c.generation++
+}
+
+var stationTiles tileCache
+
+type TilesController struct{}
+
+func parseTile(r *http.Request) (int, int, int, error) {
+	z, err := strconv.Atoi(r.PathValue("z"))
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	x, err := strconv.Atoi(r.PathValue("x"))
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	y, err := strconv.Atoi(strings.TrimSuffix(r.PathValue("y"), ".mvt"))
+	if err != nil {
+		return 0, 0, 0, err
+	}
+
+	if z < 0 || z > maxTileZoom || x < 0 || y < 0 || x >= 1<<z || y >= 1<<z {
+		return 0, 0, 0, errors.New(fmt.Sprintf("invalid tile: %d/%d/%d", z, x, y))
+	}
+
+	return z, x, y, nil
+}
+
+func encodeStationTile(z, x, y int) ([]byte, error) {
+	stations, err := stationsInBBox(tileBBox(z, x, y))
+	if err != nil {
+		return nil, err
+	}
+
+	layer := newMvtLayer("stations")
+	for _, station := range stations {
+		tx, ty := tileCoordinates(station.Lat, station.Lon, z, x, y)
+		layer.AddPoint(mvtFeature{
+			Id: uint64(station.StationId),
+			X:  tx,
+			Y:  ty,
+			Properties: map[string]any{
+				"station_id":         station.StationId,
+				"name":               station.Name,
+				"capacity":           station.Capacity,
+				"numBikesAvailable":  station.BikeCount,
+				"numEBikesAvailable": station.EBikeCount,
+				"numDocksAvailable":  station.DockCount,
+			},
+		})
+	}
+
+	return EncodeTile(layer)
+}
+
+func (c *TilesController) ShowStations(w http.ResponseWriter, r *http.Request) {
+	if !strings.HasSuffix(r.PathValue("y"), ".mvt") {
+		http.NotFound(w, r)
+		return
+	}
+
+	z, x, y, err := parseTile(r)
+	if err != nil {
+		defer handleHttpBadRequest(w, err)
+		return
+	}
+
+	key := fmt.Sprintf("%d/%d/%d", z, x, y)
+	tile, generation, ok := stationTiles.Get(key)
+	if !ok {
+		tile, err = encodeStationTile(z, x, y)
+		if err != nil {
+			defer handleHttpError(w, err)
+			return
+		}
+		stationTiles.Put(key, tile, generation)
+	}
+
+	w.Header().Set("Content-Type", "application/vnd.mapbox-vector-tile")
+	_, err = w.Write(tile)
+	if err != nil {
+		defer handleHttpError(w, err)
+		return
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"math"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+const (
+	trendWindow     = 10 * time.Minute
+	minTrendSamples = 3
+	// slower changes, in bikes per minute, are reported as stable
+	stableTrendRate = 0.1
+)
+
+type StationTrend struct {
+	// least squares slopes over the last trendWindow, per minute
+	BikesPerMinute float64
+	DocksPerMinute float64
+	// filling (bikes arriving), emptying (bikes leaving) or stable
+	Direction string
+	// minutes until no bike, or no dock, is left at the current rate
+	MinutesToEmpty *float64 `json:",omitempty"`
+	MinutesToFull  *float64 `json:",omitempty"`
+}
+
+// slope returns the least squares slope of ys over xs.
+func slope(xs, ys []float64) float64 {
+	n := float64(len(xs))
+	var sx, sy, sxx, sxy float64
+	for i := range xs {
+		sx += xs[i]
+		sy += ys[i]
+		sxx += xs[i] * xs[i]
+		sxy += xs[i] * ys[i]
+	}
+
+	d := n*sxx - sx*sx
+	if d == 0 {
+		return 0
+	}
+	return (n*sxy - sx*sy) / d
+}
+
+func computeTrend(snapshots []StationSnapshot) StationTrend {
+	var minutes, bikes, docks []float64
+	for _, snapshot := range snapshots {
+		minutes = append(minutes, snapshot.RecordedAt.Sub(snapshots[0].RecordedAt).Minutes())
+		bikes = append(bikes, float64(snapshot.BikeCount))
+		docks = append(docks, float64(snapshot.DockCount))
+	}
+
+	trend := StationTrend{
+		BikesPerMinute: math.Round(slope(minutes, bikes)*100) / 100,
+		DocksPerMinute: math.Round(slope(minutes, docks)*100) / 100,
+		Direction:      "stable",
+	}
+	if trend.BikesPerMinute > stableTrendRate {
+		trend.Direction = "filling"
+	} else if trend.BikesPerMinute < -stableTrendRate {
+		trend.Direction = "emptying"
+	}
+
+	last := snapshots[len(snapshots)-1]
+	if trend.BikesPerMinute < -stableTrendRate {
+		m := math.Round(float64(last.BikeCount) / -trend.BikesPerMinute)
+		trend.MinutesToEmpty = &m
+	}
+	if trend.DocksPerMinute < -stableTrendRate {
+		m := math.Round(float64(last.DockCount) / -trend.DocksPerMinute)
+		trend.MinutesToFull = &m
+	}
+
+	return trend
+}
+
+// stationTrends computes the trend of the given stations from their
+// snapshots in the trendWindow before at, or before now when at is zero.
+// Stations with too few snapshots are left out.
+func stationTrends(stationIds []int, at time.Time) (map[int]StationTrend, error) {
+	if at.IsZero() {
+		at = time.Now()
+	}
+
+	ids := make([]int64, len(stationIds))
+	for i, id := range stationIds {
+		ids[i] = int64(id)
+	}
+
+	rows, err := db.Query("SELECT station_id, bike_count, ebike_count, dock_count, recorded_at FROM station_history WHERE station_id = ANY($1) AND recorded_at > $2 AND recorded_at <= $3 ORDER BY station_id, recorded_at",
+		pq.Array(ids), at.Add(-trendWindow), at)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	history := map[int][]StationSnapshot{}
+	for rows.Next() {
+		var id int
+		var snapshot StationSnapshot
+		err := rows.Scan(&id, &snapshot.BikeCount, &snapshot.EBikeCount, &snapshot.DockCount, &snapshot.RecordedAt)
+		if err != nil {
+			return nil, err
+		}
+		history[id] = append(history[id], snapshot)
+	}
+	if rows.Err() != nil {
+		return nil, rows.Err()
+	}
+
+	trends := map[int]StationTrend{}
+	for id, snapshots := range history {
+		if len(snapshots) >= minTrendSamples {
+			trends[id] = computeTrend(snapshots)
+		}
+	}
+
+	return trends, nil
+}
+
+// withTrends sets the trend of each station.
+func withTrends(stations []Station, at time.Time) error {
+	if len(stations) == 0 {
+		return nil
+	}
+
+	ids := make([]int, len(stations))
+	for i, station := range stations {
+		ids[i] = station.StationId
+	}
+
+	trends, err := stationTrends(ids, at)
+	if err != nil {
+		return err
+	}
+	for i, station := range stations {
+		trend, ok := trends[station.StationId]
+		if ok {
+			stations[i].Trend = &trend
+		}
+	}
+
+	return nil
+}
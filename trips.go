@@ -0,0 +1,324 @@
+package main
+
+import (
+	"math"
+	"slices"
+	"time"
+)
+
+// Trip planning: walk to a station with a bike, ride to a station with a
+// free dock, walk to the destination. Ride distances come from the walking
+// graph as well, pedestrian and cycling networks being close enough in town.
+
+const (
+	// meters per second
+	mechanicalSpeed = 4.2
+	ebikeSpeed      = 5.5
+	// time to take a bike out, or dock it
+	dockingSeconds = 60
+	// candidate stations considered at each end
+	tripCandidates     = 8
+	defaultTripWalk    = 800
+	maxTripWalk        = 2000
+	defaultItineraries = 3
+	maxItineraries     = 10
+	maxRiders          = 4
+	defaultMaxLegs     = 4
+	maxMaxLegs         = 8
+	// dock this long before the free time runs out, in seconds
+	freeTimeMargin = 3 * 60
+	// in free time mode, itineraries split out of the fastest, per
+	// itinerary returned
+	splitCandidates = 4
+	// how far off the straight line intermediate stations are looked for
+	splitCorridor = 2000
+)
+
+type TripLeg struct {
+	// walk or ride
+	Mode string
+	// for rides, mechanical or ebike
+	Bike        string `json:",omitempty"`
+	From        latLon
+	To          latLon
+	FromStation *Station `json:",omitempty"`
+	ToStation   *Station `json:",omitempty"`
+	Meters      int
+	Seconds     int
+}
+
+type Itinerary struct {
+	TotalSeconds int
+	Legs         []TripLeg
+	// the ride could not be split to stay within the free time
+	ExceedsFreeTime bool `json:",omitempty"`
+	// expected price with each pricing plan
+	Costs []CostEstimate
+}
+
+type TripPlan struct {
+	// for comparison, walking all the way
+	WalkOnlySeconds int
+	Itineraries     []Itinerary
+}
+
+type TripRequest struct {
+	Origin      latLon
+	Destination latLon
+	// any, mechanical or ebike
+	Bike string
+	// bikes needed at pickup and docks at drop-off
+	Riders int
+	// maximum walk at each end, in meters
+	MaxWalk     int
+	Itineraries int
+	// free minutes per ride of the subscription, rides being split into
+	// legs docking at intermediate stations to stay within them. Zero
+	// rides straight through.
+	FreeMinutes int
+	// maximum ride legs of a split ride
+	MaxLegs int
+	At      time.Time
+}
+
+func (r TripRequest) bikesAvailable(station Station) int {
+	switch r.Bike {
+	case "ebike":
+		return station.EBikeCount
+	case "mechanical":
+		return station.MechanicalCount()
+	}
+	return station.BikeCount
+}
+
+// rideBike is the kind of bike taken at a station, e-bikes being taken
+// when asked for, or when they are all that is left.
+func (r TripRequest) rideBike(pickup Station) string {
+	if r.Bike == "ebike" || (r.Bike == "any" && pickup.MechanicalCount() < r.Riders) {
+		return "ebike"
+	}
+	return "mechanical"
+}
+
+func bikeSpeed(bike string) float64 {
+	if bike == "ebike" {
+		return ebikeSpeed
+	}
+	return mechanicalSpeed
+}
+
+// rideSeconds is the time a ride of meters takes on a bike, from taking it
+// out to docking it, which is both its duration and the rented time.
+func rideSeconds(meters float64, bike string) float64 {
+	return meters/bikeSpeed(bike) + 2*dockingSeconds
+}
+
+// tripCandidatesNear returns the closest stations to a point satisfying
+// ok, with their walking distance.
+func tripCandidatesNear(point latLon, maxWalk int, at time.Time, ok func(Station) bool) ([]Station, error) {
+	stations, err := stationsWithin(point.Lat, point.Lon, maxWalk, at)
+	if err != nil {
+		return nil, err
+	}
+
+	stations = slices.DeleteFunc(stations, func(station Station) bool { return !ok(station) })
+	if len(stations) > tripCandidates {
+		stations = stations[:tripCandidates]
+	}
+	return stations, nil
+}
+
+func walkLeg(from, to latLon, meters float64, fromStation, toStation *Station) TripLeg {
+	return TripLeg{Mode: "walk", From: from, To: to, FromStation: fromStation, ToStation: toStation, Meters: int(meters), Seconds: walkingSeconds(meters)}
+}
+
+func rideLeg(from, to *Station, meters float64, bike string) TripLeg {
+	return TripLeg{
+		Mode:        "ride",
+		Bike:        bike,
+		From:        latLon{Lat: from.Lat, Lon: from.Lon},
+		To:          latLon{Lat: to.Lat, Lon: to.Lon},
+		FromStation: from,
+		ToStation:   to,
+		Meters:      int(meters),
+		Seconds:     int(math.Round(rideSeconds(meters, bike))),
+	}
+}
+
+func (it *Itinerary) add(leg TripLeg) {
+	it.Legs = append(it.Legs, leg)
+	it.TotalSeconds += leg.Seconds
+}
+
+// planTrip tries every pair of candidate pickup and drop-off stations and
+// returns the fastest itineraries.
+func planTrip(r TripRequest) (TripPlan, error) {
+	plan := TripPlan{
+		WalkOnlySeconds: walkingSeconds(routeDistances(r.Origin, []latLon{r.Destination})[0]),
+		Itineraries:     []Itinerary{},
+	}
+
+	pickups, err := tripCandidatesNear(r.Origin, r.MaxWalk, r.At, func(station Station) bool { return r.bikesAvailable(station) >= r.Riders })
+	if err != nil {
+		return plan, err
+	}
+	dropoffs, err := tripCandidatesNear(r.Destination, r.MaxWalk, r.At, func(station Station) bool { return station.DockCount >= r.Riders })
+	if err != nil {
+		return plan, err
+	}
+
+	dropoffPoints := make([]latLon, len(dropoffs))
+	for i, dropoff := range dropoffs {
+		dropoffPoints[i] = latLon{Lat: dropoff.Lat, Lon: dropoff.Lon}
+	}
+
+	for i := range pickups {
+		pickup := &pickups[i]
+		rides := routeDistances(latLon{Lat: pickup.Lat, Lon: pickup.Lon}, dropoffPoints)
+		for j := range dropoffs {
+			dropoff := &dropoffs[j]
+			if pickup.StationId == dropoff.StationId {
+				continue
+			}
+
+			var itinerary Itinerary
+			itinerary.add(walkLeg(r.Origin, latLon{Lat: pickup.Lat, Lon: pickup.Lon}, float64(pickup.Distance), nil, pickup))
+			itinerary.add(rideLeg(pickup, dropoff, rides[j], r.rideBike(*pickup)))
+			itinerary.add(walkLeg(latLon{Lat: dropoff.Lat, Lon: dropoff.Lon}, r.Destination, float64(dropoff.Distance), dropoff, nil))
+			plan.Itineraries = append(plan.Itineraries, itinerary)
+		}
+	}
+
+	slices.SortStableFunc(plan.Itineraries, func(a Itinerary, b Itinerary) int { return a.TotalSeconds - b.TotalSeconds })
+	if r.FreeMinutes > 0 && len(plan.Itineraries) > 0 {
+		// splitting only adds docking time, so the fastest itineraries
+		// are still among the fastest once split
+		plan.Itineraries = plan.Itineraries[:min(len(plan.Itineraries), r.Itineraries*splitCandidates)]
+		err = r.splitRides(plan.Itineraries)
+		if err != nil {
+			return plan, err
+		}
+		slices.SortStableFunc(plan.Itineraries, func(a Itinerary, b Itinerary) int {
+			if a.ExceedsFreeTime != b.ExceedsFreeTime {
+				if a.ExceedsFreeTime {
+					return 1
+				}
+				return -1
+			}
+			return a.TotalSeconds - b.TotalSeconds
+		})
+	}
+	if len(plan.Itineraries) > r.Itineraries {
+		plan.Itineraries = plan.Itineraries[:r.Itineraries]
+	}
+
+	return plan, withCosts(plan, r)
+}
+
+// rideBudget is the time in seconds a leg can spend riding, docking at
+// both ends aside, while its rideSeconds stay within the free time.
+func (r TripRequest) rideBudget() float64 {
+	return float64(r.FreeMinutes*60 - freeTimeMargin - 2*dockingSeconds)
+}
+
+// corridor returns the bbox around two points where intermediate stations
+// are looked for.
+func corridor(a, b latLon) BBox {
+	from := RadiusBBox(a.Lat, a.Lon, splitCorridor)
+	to := RadiusBBox(b.Lat, b.Lon, splitCorridor)
+	return BBox{
+		West:  math.Min(from.West, to.West),
+		South: math.Min(from.South, to.South),
+		East:  math.Max(from.East, to.East),
+		North: math.Max(from.North, to.North),
+	}
+}
+
+// splitRides replaces the ride of each itinerary, made of a walk, a ride
+// and a walk, by legs short enough to stay within the free time, or flags
+// it when it cannot be split in at most MaxLegs legs.
+func (r TripRequest) splitRides(itineraries []Itinerary) error {
+	for i := range itineraries {
+		ride := itineraries[i].Legs[1]
+		if float64(ride.Seconds-2*dockingSeconds) <= r.rideBudget() {
+			continue
+		}
+
+		pool, err := stationsInBBoxAt(corridor(ride.From, ride.To), r.At)
+		if err != nil {
+			return err
+		}
+		rides, ok := r.splitRide(ride.FromStation, ride.ToStation, float64(ride.Meters), pool)
+		if !ok {
+			itineraries[i].ExceedsFreeTime = true
+			continue
+		}
+
+		legs := itineraries[i].Legs
+		itineraries[i] = Itinerary{}
+		itineraries[i].add(legs[0])
+		for _, leg := range rides {
+			itineraries[i].add(leg)
+		}
+		itineraries[i].add(legs[2])
+	}
+	return nil
+}
+
+// splitRide greedily rides from pickup to the intermediate station within
+// the free time which gets closest to the drop-off, until the drop-off
+// itself is within reach. Intermediate stations need a dock to return the
+// bike and a bike to take again for every rider.
+func (r TripRequest) splitRide(pickup, dropoff *Station, meters float64, pool []Station) ([]TripLeg, bool) {
+	legs := []TripLeg{}
+	destination := latLon{Lat: dropoff.Lat, Lon: dropoff.Lon}
+	current := pickup
+	for {
+		bike := r.rideBike(*current)
+		reach := r.rideBudget() * bikeSpeed(bike)
+		if meters <= reach {
+			return append(legs, rideLeg(current, dropoff, meters, bike)), true
+		}
+		if len(legs) >= r.MaxLegs-1 {
+			return nil, false
+		}
+
+		from := latLon{Lat: current.Lat, Lon: current.Lon}
+		stops := []*Station{}
+		points := []latLon{}
+		for j := range pool {
+			stop := &pool[j]
+			if stop.StationId == current.StationId || stop.StationId == dropoff.StationId {
+				continue
+			}
+			if r.bikesAvailable(*stop) < r.Riders || stop.DockCount < r.Riders {
+				continue
+			}
+			if distanceMeters(from.Lat, from.Lon, stop.Lat, stop.Lon) > reach {
+				continue
+			}
+			stops = append(stops, stop)
+			points = append(points, latLon{Lat: stop.Lat, Lon: stop.Lon})
+		}
+
+		rides := routeDistances(from, points)
+		next := -1
+		remaining := distanceMeters(from.Lat, from.Lon, destination.Lat, destination.Lon)
+		for j, stop := range stops {
+			if rides[j] > reach {
+				continue
+			}
+			left := distanceMeters(stop.Lat, stop.Lon, destination.Lat, destination.Lon)
+			if left < remaining {
+				next, remaining = j, left
+			}
+		}
+		if next < 0 {
+			return nil, false
+		}
+
+		legs = append(legs, rideLeg(current, stops[next], rides[next], bike))
+		current = stops[next]
+		meters = routeDistances(points[next], []latLon{destination})[0]
+	}
+}
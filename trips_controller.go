@@ -0,0 +1,87 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+)
+
+type TripsController struct{}
+
+func parseTripRequest(params url.Values) (TripRequest, error) {
+	var r TripRequest
+	var err error
+	r.Origin, err = parseLocation(params.Get("origin"))
+	if err != nil {
+		return r, err
+	}
+	r.Destination, err = parseLocation(params.Get("destination"))
+	if err != nil {
+		return r, err
+	}
+
+	r.Bike = params.Get("bike")
+	if r.Bike == "" {
+		r.Bike = "any"
+	}
+	if r.Bike != "any" && r.Bike != "mechanical" && r.Bike != "ebike" {
+		return r, errors.New("bike must be any, mechanical or ebike")
+	}
+
+	r.Riders, err = optionalInt(params, "riders", 1)
+	if err != nil {
+		return r, err
+	}
+	r.Riders = min(max(r.Riders, 1), maxRiders)
+
+	r.MaxWalk, err = optionalInt(params, "max_walk", defaultTripWalk)
+	if err != nil {
+		return r, err
+	}
+	r.MaxWalk = min(max(r.MaxWalk, 0), maxTripWalk)
+
+	r.Itineraries, err = optionalInt(params, "limit", defaultItineraries)
+	if err != nil {
+		return r, err
+	}
+	r.Itineraries = min(max(r.Itineraries, 1), maxItineraries)
+
+	r.FreeMinutes, err = optionalInt(params, "free_minutes", 0)
+	if err != nil {
+		return r, err
+	}
+	if r.FreeMinutes != 0 && r.rideBudget() <= 0 {
+		return r, errors.New("free_minutes is too short to ride")
+	}
+
+	r.MaxLegs, err = optionalInt(params, "max_legs", defaultMaxLegs)
+	if err != nil {
+		return r, err
+	}
+	r.MaxLegs = min(max(r.MaxLegs, 1), maxMaxLegs)
+
+	r.At, err = parseAt(params)
+	return r, err
+}
+
+func (c *TripsController) Plan(w http.ResponseWriter, r *http.Request) {
+	request, err := parseTripRequest(r.URL.Query())
+	if err != nil {
+		defer handleHttpBadRequest(w, err)
+		return
+	}
+
+	plan, err := planTrip(request)
+	if err != nil {
+		defer handleHttpError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(plan)
+	if err != nil {
+		defer handleHttpError(w, err)
+		return
+	}
+}
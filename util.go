@@ -1,8 +1,17 @@
 package main
 
-import "math"
+import (
+	"math"
+	"net/url"
+	"strconv"
+)
 
 func Haversine(lat1, lon1, lat2, lon2 float64) int {
+	return int(distanceMeters(lat1, lon1, lat2, lon2))
+}
+
+// distanceMeters is Haversine without rounding, for short distances.
+func distanceMeters(lat1, lon1, lat2, lon2 float64) float64 {
 	lat1 = lat1 * math.Pi / 180
 	lon1 = lon1 * math.Pi / 180
 	lat2 = lat2 * math.Pi / 180
@@ -16,5 +25,14 @@ func Haversine(lat1, lon1, lat2, lon2 float64) int {
 	a := math.Pow(math.Sin(dlat/2), 2) + math.Cos(lat1)*math.Cos(lat2)*math.Pow(math.Sin(dlon/2), 2)
 	c := 2 * math.Atan2(math.Sqrt(a), math.Sqrt(1-a))
 
-	return int(1000 * R * c)
+	return 1000 * R * c
+}
+
+// optionalInt reads an integer query parameter, falling back when it is absent.
+func optionalInt(params url.Values, name string, fallback int) (int, error) {
+	if !params.Has(name) {
+		return fallback, nil
+	}
+
+	return strconv.Atoi(params.Get(name))
 }
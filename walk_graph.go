@@ -0,0 +1,181 @@
+package main
+
+import (
+	"container/heap"
+	"math"
+	"slices"
+	"sort"
+)
+
+// walkGraph is a pedestrian road graph in compressed sparse row form: the
+// edges leaving node i are targets[offsets[i]:offsets[i+1]].
+type walkGraph struct {
+	lat, lon []float64
+	offsets  []int32
+	targets  []int32
+	lengths  []float32
+	grid     map[[2]int32][]int32
+}
+
+const (
+	// grid cells used to snap points to the graph, in degrees
+	walkGridCell = 0.002
+	// farther than this from any path, a point cannot be routed from
+	maxSnapDistance = 300
+)
+
+var walkableHighways = map[string]bool{
+	"footway": true, "pedestrian": true, "path": true, "steps": true, "living_street": true,
+	"residential": true, "service": true, "unclassified": true, "tertiary": true, "tertiary_link": true,
+	"secondary": true, "secondary_link": true, "primary": true, "primary_link": true, "track": true,
+	"cycleway": true, "road": true, "corridor": true, "platform": true,
+}
+
+// walkable tells whether a way with these tags can be walked along.
+func walkable(tags map[string]string) bool {
+	if tags["foot"] == "no" || tags["access"] == "no" || tags["access"] == "private" || tags["area"] == "yes" {
+		return false
+	}
+	if tags["foot"] == "yes" || tags["foot"] == "designated" {
+		return tags["highway"] != ""
+	}
+	return walkableHighways[tags["highway"]]
+}
+
+func gridCell(lat, lon float64) [2]int32 {
+	return [2]int32{int32(math.Floor(lat / walkGridCell)), int32(math.Floor(lon / walkGridCell))}
+}
+
+// loadWalkGraph builds the graph from an OSM extract, reading it twice: once
+// for the walkable ways, then for the coordinates of the nodes they use.
+func loadWalkGraph(path string) (*walkGraph, error) {
+	index := map[int64]int32{}
+	var edges [][2]int32
+	err := readOsmFile(path, osmHandler{Way: func(id int64, refs []int64, tags map[string]string) {
+		if !walkable(tags) {
+			return
+		}
+		for i, ref := range refs {
+			n, ok := index[ref]
+			if !ok {
+				n = int32(len(index))
+				index[ref] = n
+			}
+			if i > 0 {
+				previous := index[refs[i-1]]
+				if previous != n {
+					edges = append(edges, [2]int32{previous, n}, [2]int32{n, previous})
+				}
+			}
+		}
+	}})
+	if err != nil {
+		return nil, err
+	}
+
+	g := &walkGraph{lat: make([]float64, len(index)), lon: make([]float64, len(index)), grid: map[[2]int32][]int32{}}
+	found := make([]bool, len(index))
+	err = readOsmFile(path, osmHandler{Node: func(id int64, lat, lon float64) {
+		n, ok := index[id]
+		if ok {
+			g.lat[n], g.lon[n], found[n] = lat, lon, true
+		}
+	}})
+	if err != nil {
+		return nil, err
+	}
+
+	// extracts cut at their boundary reference nodes they do not contain
+	edges = slices.DeleteFunc(edges, func(e [2]int32) bool { return !found[e[0]] || !found[e[1]] })
+	sort.Slice(edges, func(i, j int) bool { return edges[i][0] < edges[j][0] })
+
+	g.offsets = make([]int32, len(index)+1)
+	g.targets = make([]int32, len(edges))
+	g.lengths = make([]float32, len(edges))
+	for i, e := range edges {
+		g.offsets[e[0]+1]++
+		g.targets[i] = e[1]
+		g.lengths[i] = float32(distanceMeters(g.lat[e[0]], g.lon[e[0]], g.lat[e[1]], g.lon[e[1]]))
+	}
+	for i := 1; i < len(g.offsets); i++ {
+		g.offsets[i] += g.offsets[i-1]
+	}
+
+	for n := range g.lat {
+		if found[n] && g.offsets[n+1] > g.offsets[n] {
+			cell := gridCell(g.lat[n], g.lon[n])
+			g.grid[cell] = append(g.grid[cell], int32(n))
+		}
+	}
+
+	return g, nil
+}
+
+func (g *walkGraph) Nodes() int {
+	return len(g.lat)
+}
+
+// Snap returns the node closest to a point and the distance to it.
+func (g *walkGraph) Snap(lat, lon float64) (int32, float64, bool) {
+	center := gridCell(lat, lon)
+	best, bestDistance := int32(-1), math.Inf(1)
+	for radius := int32(1); radius <= 2 && best < 0; radius++ {
+		for dlat := -radius; dlat <= radius; dlat++ {
+			for dlon := -radius; dlon <= radius; dlon++ {
+				for _, n := range g.grid[[2]int32{center[0] + dlat, center[1] + dlon}] {
+					d := distanceMeters(lat, lon, g.lat[n], g.lon[n])
+					if d < bestDistance {
+						best, bestDistance = n, d
+					}
+				}
+			}
+		}
+	}
+
+	return best, bestDistance, best >= 0 && bestDistance <= maxSnapDistance
+}
+
+type walkQueueItem struct {
+	node     int32
+	priority float64
+}
+
+type walkQueue []walkQueueItem
+
+func (q walkQueue) Len() int           { return len(q) }
+func (q walkQueue) Less(i, j int) bool { return q[i].priority < q[j].priority }
+func (q walkQueue) Swap(i, j int)      { q[i], q[j] = q[j], q[i] }
+func (q *walkQueue) Push(x any)        { *q = append(*q, x.(walkQueueItem)) }
+func (q *walkQueue) Pop() any          { old := *q; item := old[len(old)-1]; *q = old[:len(old)-1]; return item }
+
+// DistancesFrom runs Dijkstra from a node up to maxDistance meters, giving
+// the distances to every node within reach with one search.
+func (g *walkGraph) DistancesFrom(from int32, maxDistance float64) map[int32]float64 {
+	distances := map[int32]float64{from: 0}
+	done := map[int32]bool{}
+	queue := &walkQueue{{node: from}}
+
+	for queue.Len() > 0 {
+		item := heap.Pop(queue).(walkQueueItem)
+		n := item.node
+		if done[n] {
+			continue
+		}
+		done[n] = true
+
+		for e := g.offsets[n]; e < g.offsets[n+1]; e++ {
+			target := g.targets[e]
+			d := distances[n] + float64(g.lengths[e])
+			if d > maxDistance {
+				continue
+			}
+			current, seen := distances[target]
+			if !seen || d < current {
+				distances[target] = d
+				heap.Push(queue, walkQueueItem{node: target, priority: d})
+			}
+		}
+	}
+
+	return distances
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+const (
+	defaultWatchDuration = 2 * time.Hour
+	maxWatchDuration     = 24 * time.Hour
+	// expired and triggered watches are kept this long for status lookups
+	watchRetention = 24 * time.Hour
+)
+
+// Watch fires once, when a station, or any station within a radius of a
+// point, has at least Threshold bikes, e-bikes, mechanical bikes or docks.
+// It is delivered either to a webhook or as a Web Push notification.
+type Watch struct {
+	Id         int      `json:"id"`
+	StationId  *int     `json:"station_id,omitempty"`
+	Latitude   *float64 `json:"latitude,omitempty"`
+	Longitude  *float64 `json:"longitude,omitempty"`
+	Radius     *int     `json:"radius,omitempty"`
+	Kind       string   `json:"kind"`
+	Threshold  int      `json:"threshold"`
+	WebhookUrl string   `json:"webhook_url,omitempty"`
+	// only set when creating a watch, as it is stored separately
+	PushSubscription   *PushSubscription `json:"push_subscription,omitempty"`
+	PushSubscriptionId *int              `json:"push_subscription_id,omitempty"`
+	Secret             string            `json:"secret,omitempty"`
+	CreatedAt          time.Time         `json:"created_at"`
+	ExpiresAt          time.Time         `json:"expires_at"`
+	TriggeredAt        *time.Time        `json:"triggered_at,omitempty"`
+}
+
+// WatchEvent is the payload delivered when a watch fires.
+type WatchEvent struct {
+	WatchId     int       `json:"watch_id"`
+	Kind        string    `json:"kind"`
+	Threshold   int       `json:"threshold"`
+	TriggeredAt time.Time `json:"triggered_at"`
+	Stations    []Station `json:"stations"`
+}
+
+func (w Watch) Validate() error {
+	if !validAvailabilityKind(w.Kind) {
+		return errors.New("kind must be bikes, ebikes, mechanical or docks")
+	}
+	if w.Threshold < 1 {
+		return errors.New("threshold must be at least 1")
+	}
+
+	if w.StationId == nil && (w.Latitude == nil || w.Longitude == nil || w.Radius == nil) {
+		return errors.New("station_id or latitude, longitude and radius are required")
+	}
+	if w.StationId != nil && (w.Latitude != nil || w.Longitude != nil || w.Radius != nil) {
+		return errors.New("station_id and an area cannot both be watched")
+	}
+	if w.Radius != nil && (*w.Radius <= 0 || *w.Radius > maxClosestRadius) {
+		return errors.New(fmt.Sprintf("radius must be between 1 and %d meters", maxClosestRadius))
+	}
+
+	if (w.WebhookUrl == "") == (w.PushSubscription == nil) {
+		return errors.New("either webhook_url or push_subscription is required")
+	}
+	if w.PushSubscription != nil {
+		return w.PushSubscription.Validate()
+	}
+	return validatePublicUrl("webhook_url", w.WebhookUrl)
+}
+
+// Matching returns the stations of the snapshot satisfying the watch.
+func (w Watch) Matching(snapshot *StationsSnapshot) []Station {
+	var stations []Station
+	if w.StationId != nil {
+		station, ok := snapshot.Stations[*w.StationId]
+		if ok && station.Available(w.Kind) >= w.Threshold {
+			stations = append(stations, station)
+		}
+		return stations
+	}
+
+	for _, station := range snapshot.Stations {
+		if station.Available(w.Kind) < w.Threshold {
+			continue
+		}
+		station.Distance = Haversine(*w.Latitude, *w.Longitude, station.Lat, station.Lon)
+		if station.Distance <= *w.Radius {
+			stations = append(stations, station)
+		}
+	}
+	return stations
+}
+
+func newWatchSecret() (string, error) {
+	b := make([]byte, 32)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func createWatch(w *Watch, duration time.Duration) error {
+	secret, err := newWatchSecret()
+	if err != nil {
+		return err
+	}
+	w.Secret = secret
+
+	if w.PushSubscription != nil {
+		var id int
+		// only the holder of the auth secret may update a subscription
+		err = db.QueryRow("INSERT INTO push_subscriptions (endpoint, p256dh, auth) VALUES ($1, $2, $3) ON CONFLICT (endpoint) DO UPDATE SET p256dh = EXCLUDED.p256dh WHERE push_subscriptions.auth = EXCLUDED.auth RETURNING id",
+			w.PushSubscription.Endpoint, w.PushSubscription.Keys.P256dh, w.PushSubscription.Keys.Auth).Scan(&id)
+		if errors.Is(err, sql.ErrNoRows) {
+			return errPushSubscriptionConflict
+		}
+		if err != nil {
+			return err
+		}
+		w.PushSubscriptionId = &id
+		w.PushSubscription = nil
+	}
+
+	return db.QueryRow("INSERT INTO watches (station_id, lat, lon, radius, kind, threshold, webhook_url, push_subscription_id, secret, expires_at) VALUES ($1, $2, $3, $4, $5, $6, NULLIF($7, ''), $8, $9, NOW() + $10 * INTERVAL '1 second') RETURNING id, created_at, expires_at",
+		w.StationId, w.Latitude, w.Longitude, w.Radius, w.Kind, w.Threshold, w.WebhookUrl, w.PushSubscriptionId, w.Secret, int(duration.Seconds())).
+		Scan(&w.Id, &w.CreatedAt, &w.ExpiresAt)
+}
+
+const watchColumns = "id, station_id, lat, lon, radius, kind, threshold, COALESCE(webhook_url, ''), push_subscription_id, secret, created_at, expires_at, triggered_at"
+
+func scanWatch(row interface{ Scan(...any) error }) (Watch, error) {
+	var w Watch
+	err := row.Scan(&w.Id, &w.StationId, &w.Latitude, &w.Longitude, &w.Radius, &w.Kind, &w.Threshold, &w.WebhookUrl, &w.PushSubscriptionId, &w.Secret, &w.CreatedAt, &w.ExpiresAt, &w.TriggeredAt)
+	return w, err
+}
+
+func findWatch(id int) (Watch, error) {
+	return scanWatch(db.QueryRow("SELECT "+watchColumns+" FROM watches WHERE id = $1", id))
+}
+
+func deleteWatch(id int) error {
+	_, err := db.Exec("DELETE FROM watches WHERE id = $1", id)
+	return err
+}
+
+func activeWatches() ([]Watch, error) {
+	rows, err := db.Query("SELECT " + watchColumns + " FROM watches WHERE triggered_at IS NULL AND expires_at > NOW()")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var watches []Watch
+	for rows.Next() {
+		w, err := scanWatch(rows)
+		if err != nil {
+			return nil, err
+		}
+		watches = append(watches, w)
+	}
+	return watches, rows.Err()
+}
+
+// triggerWatch marks the watch as fired and queues its webhook or push
+// notification, unless another evaluation got there first.
+func triggerWatch(w Watch, event WatchEvent) error {
+	deliveries := "webhook_deliveries"
+	payload, err := json.Marshal(event)
+	if w.PushSubscriptionId != nil {
+		deliveries = "push_deliveries"
+		payload, err = pushNotification(event)
+	}
+	if err != nil {
+		return err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+
+	result, err := tx.Exec("UPDATE watches SET triggered_at = $2 WHERE id = $1 AND triggered_at IS NULL", w.Id, event.TriggeredAt)
+	if err != nil {
+		return errors.Join(err, tx.Rollback())
+	}
+	updated, err := result.RowsAffected()
+	if err != nil || updated == 0 {
+		return errors.Join(err, tx.Rollback())
+	}
+
+	_, err = tx.Exec("INSERT INTO "+deliveries+" (watch_id, payload) VALUES ($1, $2)", w.Id, string(payload))
+	if err != nil {
+		return errors.Join(err, tx.Rollback())
+	}
+
+	return tx.Commit()
+}
+
+// evaluateWatches fires the active watches satisfied by the snapshot and
+// drops the ones past retention.
+func evaluateWatches(snapshot *StationsSnapshot) error {
+	_, err := db.Exec("DELETE FROM watches WHERE expires_at < $1", time.Now().Add(-watchRetention))
+	if err != nil {
+		return err
+	}
+
+	watches, err := activeWatches()
+	if err != nil {
+		return err
+	}
+
+	var errs []error
+	triggered := false
+	for _, w := range watches {
+		stations := w.Matching(snapshot)
+		if len(stations) == 0 {
+			continue
+		}
+
+		err := triggerWatch(w, WatchEvent{WatchId: w.Id, Kind: w.Kind, Threshold: w.Threshold, TriggeredAt: snapshot.At, Stations: stations})
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		triggered = true
+	}
+
+	if triggered {
+		wakeDeliveries()
+	}
+	return errors.Join(errs...)
+}
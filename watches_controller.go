@@ -0,0 +1,131 @@
+package main
+
+import (
+	"crypto/subtle"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type WatchesController struct{}
+
+// authorizedWatch loads the watch named in the path, checking the secret
+// handed out on creation is presented as a bearer token.
+func authorizedWatch(w http.ResponseWriter, r *http.Request) (Watch, bool) {
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		http.NotFound(w, r)
+		return Watch{}, false
+	}
+
+	watch, err := findWatch(id)
+	if errors.Is(err, sql.ErrNoRows) {
+		http.NotFound(w, r)
+		return Watch{}, false
+	}
+	if err != nil {
+		handleHttpError(w, err)
+		return Watch{}, false
+	}
+
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if subtle.ConstantTimeCompare([]byte(token), []byte(watch.Secret)) != 1 {
+		http.NotFound(w, r)
+		return Watch{}, false
+	}
+
+	return watch, true
+}
+
+func (c *WatchesController) Create(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Watch
+		// seconds until the watch expires
+		ExpiresIn int `json:"expires_in"`
+		// in any format parseLocation reads, instead of latitude and
+		// longitude
+		Location string `json:"location"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&body)
+	if err != nil {
+		defer handleHttpBadRequest(w, err)
+		return
+	}
+
+	watch := body.Watch
+	if body.Location != "" {
+		if watch.Latitude != nil || watch.Longitude != nil {
+			defer handleHttpBadRequest(w, errors.New("location cannot be given with latitude and longitude"))
+			return
+		}
+
+		location, err := parseLocation(body.Location)
+		if err != nil {
+			defer handleHttpBadRequest(w, err)
+			return
+		}
+		watch.Latitude, watch.Longitude = &location.Lat, &location.Lon
+	}
+	err = watch.Validate()
+	if err != nil {
+		defer handleHttpBadRequest(w, err)
+		return
+	}
+
+	duration := defaultWatchDuration
+	if body.ExpiresIn > 0 {
+		duration = min(time.Duration(body.ExpiresIn)*time.Second, maxWatchDuration)
+	}
+
+	err = createWatch(&watch, duration)
+	if errors.Is(err, errPushSubscriptionConflict) {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		defer handleHttpError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	err = json.NewEncoder(w).Encode(watch)
+	if err != nil {
+		defer handleHttpError(w, err)
+		return
+	}
+}
+
+func (c *WatchesController) Show(w http.ResponseWriter, r *http.Request) {
+	watch, ok := authorizedWatch(w, r)
+	if !ok {
+		return
+	}
+	watch.Secret = ""
+
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(watch)
+	if err != nil {
+		defer handleHttpError(w, err)
+		return
+	}
+}
+
+func (c *WatchesController) Delete(w http.ResponseWriter, r *http.Request) {
+	watch, ok := authorizedWatch(w, r)
+	if !ok {
+		return
+	}
+
+	err := deleteWatch(watch.Id)
+	if err != nil {
+		defer handleHttpError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+var errNonPublicAddress = errors.New("only public addresses can be reached")
+
+// publicAddress tells whether an address is neither loopback, private,
+// link-local, multicast nor unspecified, so that user supplied urls cannot
+// reach the server itself, its network or cloud metadata services.
+func publicAddress(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	return addr.IsValid() && addr.IsGlobalUnicast() && !addr.IsPrivate()
+}
+
+// validatePublicUrl checks that a user supplied url is https and that its
+// host, as written and as resolved, only has public addresses.
+func validatePublicUrl(name, s string) error {
+	u, err := url.Parse(s)
+	if err != nil {
+		return err
+	}
+	if u.Scheme != "https" || u.Hostname() == "" {
+		return errors.New(fmt.Sprintf("%s must be an absolute https url", name))
+	}
+
+	addrs := []netip.Addr{}
+	if addr, err := netip.ParseAddr(u.Hostname()); err == nil {
+		addrs = append(addrs, addr)
+	} else {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		addrs, err = net.DefaultResolver.LookupNetIP(ctx, "ip", u.Hostname())
+		if err != nil {
+			return errors.New(fmt.Sprintf("%s host cannot be resolved: %s", name, u.Hostname()))
+		}
+	}
+
+	for _, addr := range addrs {
+		if !publicAddress(addr) {
+			return errors.New(fmt.Sprintf("%s must resolve to public addresses only", name))
+		}
+	}
+	return nil
+}
+
+// publicTransport only connects to public addresses. The check happens once
+// the host is resolved, so that DNS rebinding cannot get around the
+// validation done when the url was accepted.
+var publicTransport = &http.Transport{
+	DialContext: (&net.Dialer{
+		Timeout: 5 * time.Second,
+		Control: func(network, address string, c syscall.RawConn) error {
+			addrPort, err := netip.ParseAddrPort(address)
+			if err != nil {
+				return err
+			}
+			if !publicAddress(addrPort.Addr()) {
+				return errNonPublicAddress
+			}
+			return nil
+		},
+	}).DialContext,
+	TLSHandshakeTimeout: 5 * time.Second,
+}
+
+var webhookClient = &http.Client{Timeout: 10 * time.Second, Transport: publicTransport}
+
+// signWebhook computes the X-Velib-Signature header: a hex HMAC-SHA256 of
+// the timestamp and body joined by a dot, keyed by the watch secret.
+func signWebhook(secret string, timestamp int64, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strconv.FormatInt(timestamp, 10)))
+	mac.Write([]byte("."))
+	mac.Write(payload)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func postWebhook(url, secret string, payload []byte) error {
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+
+	timestamp := time.Now().Unix()
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Velib-Timestamp", strconv.FormatInt(timestamp, 10))
+	req.Header.Set("X-Velib-Signature", signWebhook(secret, timestamp, payload))
+
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return errors.New(fmt.Sprintf("webhook answered %s", resp.Status))
+	}
+	return nil
+}
+
+// deliverPendingWebhooks posts the due webhook deliveries.
+func deliverPendingWebhooks() error {
+	rows, err := db.Query("SELECT d.id, d.payload, d.attempts, w.webhook_url, w.secret FROM webhook_deliveries d JOIN watches w ON w.id = d.watch_id WHERE d.delivered_at IS NULL AND d.attempts < $1 AND d.next_attempt_at <= NOW() ORDER BY d.next_attempt_at LIMIT 100", maxDeliveryAttempts)
+	if err != nil {
+		return err
+	}
+
+	type delivery struct {
+		id       int
+		payload  string
+		attempts int
+		url      string
+		secret   string
+	}
+	var deliveries []delivery
+	for rows.Next() {
+		var d delivery
+		err := rows.Scan(&d.id, &d.payload, &d.attempts, &d.url, &d.secret)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		deliveries = append(deliveries, d)
+	}
+	rows.Close()
+	if rows.Err() != nil {
+		return rows.Err()
+	}
+
+	var errs []error
+	for _, d := range deliveries {
+		err := recordDeliveryAttempt("webhook_deliveries", d.id, d.attempts, postWebhook(d.url, d.secret, []byte(d.payload)))
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	return errors.Join(errs...)
+}
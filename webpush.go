@@ -0,0 +1,286 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
+)
+
+// Web Push (RFC 8030) with VAPID authentication (RFC 8292) and message
+// encryption (RFC 8291).
+
+const (
+	vapidKeyFile = "vapid.pem"
+	vapidSubject = "https://github.com/Will1608/velib-near-me"
+	pushTTL      = time.Hour
+	// a single record is used, so this only has to exceed the payload size
+	pushRecordSize = 4096
+)
+
+var (
+	errPushSubscriptionGone     = errors.New("push subscription expired")
+	errPushSubscriptionConflict = errors.New("push subscription endpoint already registered with other keys")
+)
+
+// PushSubscription is the object returned by the browser's
+// PushManager.subscribe.
+type PushSubscription struct {
+	Endpoint string `json:"endpoint"`
+	Keys     struct {
+		P256dh string `json:"p256dh"`
+		Auth   string `json:"auth"`
+	} `json:"keys"`
+}
+
+func (s PushSubscription) Validate() error {
+	err := validatePublicUrl("push subscription endpoint", s.Endpoint)
+	if err != nil {
+		return err
+	}
+
+	p256dh, err := base64.RawURLEncoding.DecodeString(s.Keys.P256dh)
+	if err != nil {
+		return err
+	}
+	_, err = ecdh.P256().NewPublicKey(p256dh)
+	if err != nil {
+		return err
+	}
+
+	auth, err := base64.RawURLEncoding.DecodeString(s.Keys.Auth)
+	if err != nil {
+		return err
+	}
+	if len(auth) != 16 {
+		return errors.New("push subscription auth secret must be 16 bytes")
+	}
+
+	return nil
+}
+
+var vapidKey *ecdsa.PrivateKey
+
+// loadVapidKey reads the VAPID key pair, generating it on first start.
+func loadVapidKey() error {
+	data, err := os.ReadFile(vapidKeyFile)
+	if errors.Is(err, fs.ErrNotExist) {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return err
+		}
+		der, err := x509.MarshalPKCS8PrivateKey(key)
+		if err != nil {
+			return err
+		}
+		err = os.WriteFile(vapidKeyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600)
+		if err != nil {
+			return err
+		}
+		vapidKey = key
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return errors.New(fmt.Sprintf("no key found in %s", vapidKeyFile))
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return err
+	}
+	ecKey, ok := key.(*ecdsa.PrivateKey)
+	if !ok || ecKey.Curve != elliptic.P256() {
+		return errors.New(fmt.Sprintf("%s must hold a P-256 key", vapidKeyFile))
+	}
+	vapidKey = ecKey
+	return nil
+}
+
+// vapidPublicKey returns the uncompressed public key, as expected by
+// PushManager.subscribe's applicationServerKey.
+func vapidPublicKey() ([]byte, error) {
+	key, err := vapidKey.PublicKey.ECDH()
+	if err != nil {
+		return nil, err
+	}
+	return key.Bytes(), nil
+}
+
+// vapidAuthorization builds the Authorization header for a push endpoint:
+// an ES256 JWT scoped to the endpoint's origin, and our public key.
+func vapidAuthorization(endpoint string) (string, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return "", err
+	}
+
+	header, err := json.Marshal(map[string]string{"typ": "JWT", "alg": "ES256"})
+	if err != nil {
+		return "", err
+	}
+	claims, err := json.Marshal(map[string]any{
+		"aud": u.Scheme + "://" + u.Host,
+		"exp": time.Now().Add(12 * time.Hour).Unix(),
+		"sub": vapidSubject,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	unsigned := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+	digest := sha256.Sum256([]byte(unsigned))
+	r, s, err := ecdsa.Sign(rand.Reader, vapidKey, digest[:])
+	if err != nil {
+		return "", err
+	}
+	signature := make([]byte, 64)
+	r.FillBytes(signature[:32])
+	s.FillBytes(signature[32:])
+
+	publicKey, err := vapidPublicKey()
+	if err != nil {
+		return "", err
+	}
+
+	return "vapid t=" + unsigned + "." + base64.RawURLEncoding.EncodeToString(signature) +
+		", k=" + base64.RawURLEncoding.EncodeToString(publicKey), nil
+}
+
+func hmacSha256(key []byte, data ...[]byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	for _, d := range data {
+		mac.Write(d)
+	}
+	return mac.Sum(nil)
+}
+
+// encryptPushPayload encrypts a message for a subscription with the
+// aes128gcm content coding (RFC 8188), keyed as described in RFC 8291.
+func encryptPushPayload(subscription PushSubscription, plaintext []byte) ([]byte, error) {
+	uaPublicBytes, err := base64.RawURLEncoding.DecodeString(subscription.Keys.P256dh)
+	if err != nil {
+		return nil, err
+	}
+	uaPublic, err := ecdh.P256().NewPublicKey(uaPublicBytes)
+	if err != nil {
+		return nil, err
+	}
+	authSecret, err := base64.RawURLEncoding.DecodeString(subscription.Keys.Auth)
+	if err != nil {
+		return nil, err
+	}
+
+	asPrivate, err := ecdh.P256().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	salt := make([]byte, 16)
+	_, err = rand.Read(salt)
+	if err != nil {
+		return nil, err
+	}
+
+	return sealPushPayload(uaPublic, authSecret, asPrivate, salt, plaintext)
+}
+
+// sealPushPayload does the encryption of encryptPushPayload with the given
+// application server key pair and salt.
+func sealPushPayload(uaPublic *ecdh.PublicKey, authSecret []byte, asPrivate *ecdh.PrivateKey, salt []byte, plaintext []byte) ([]byte, error) {
+	uaPublicBytes := uaPublic.Bytes()
+	asPublic := asPrivate.PublicKey().Bytes()
+	ecdhSecret, err := asPrivate.ECDH(uaPublic)
+	if err != nil {
+		return nil, err
+	}
+
+	// HKDF with single block expansions, all outputs being at most 32 bytes
+	prkKey := hmacSha256(authSecret, ecdhSecret)
+	keyInfo := append(append([]byte("WebPush: info\x00"), uaPublicBytes...), asPublic...)
+	ikm := hmacSha256(prkKey, keyInfo, []byte{1})
+	prk := hmacSha256(salt, ikm)
+	cek := hmacSha256(prk, []byte("Content-Encoding: aes128gcm\x00\x01"))[:16]
+	nonce := hmacSha256(prk, []byte("Content-Encoding: nonce\x00\x01"))[:12]
+
+	block, err := aes.NewCipher(cek)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	// 0x02 delimits the last, and only, record
+	padded := append(append([]byte{}, plaintext...), 2)
+	if len(padded)+gcm.Overhead() > pushRecordSize {
+		return nil, errors.New("push payload too large")
+	}
+
+	body := append([]byte{}, salt...)
+	body = binary.BigEndian.AppendUint32(body, pushRecordSize)
+	body = append(body, byte(len(asPublic)))
+	body = append(body, asPublic...)
+	return gcm.Seal(body, nonce, padded, nil), nil
+}
+
+var pushClient = &http.Client{Timeout: 10 * time.Second, Transport: publicTransport}
+
+// sendPush delivers an encrypted message to the subscription's push service.
+// It returns errPushSubscriptionGone when the subscription no longer exists.
+func sendPush(subscription PushSubscription, payload []byte) error {
+	body, err := encryptPushPayload(subscription, payload)
+	if err != nil {
+		return err
+	}
+	authorization, err := vapidAuthorization(subscription.Endpoint)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, subscription.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", authorization)
+	req.Header.Set("Content-Encoding", "aes128gcm")
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set("TTL", strconv.Itoa(int(pushTTL.Seconds())))
+	req.Header.Set("Urgency", "high")
+
+	resp, err := pushClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusGone {
+		return errPushSubscriptionGone
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return errors.New(fmt.Sprintf("push service answered %s", resp.Status))
+	}
+	return nil
+}
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// hkdf is RFC 5869 HKDF-SHA256, written out here rather than reusing the
+// derivation of sealPushPayload so that both sides are checked.
+func hkdf(salt, ikm, info []byte, length int) []byte {
+	extract := hmac.New(sha256.New, salt)
+	extract.Write(ikm)
+	prk := extract.Sum(nil)
+
+	var okm, previous []byte
+	for i := byte(1); len(okm) < length; i++ {
+		expand := hmac.New(sha256.New, prk)
+		expand.Write(previous)
+		expand.Write(info)
+		expand.Write([]byte{i})
+		previous = expand.Sum(nil)
+		okm = append(okm, previous...)
+	}
+	return okm[:length]
+}
+
+// openPushPayload decrypts an aes128gcm body as the user agent would.
+func openPushPayload(t *testing.T, uaPrivate *ecdh.PrivateKey, authSecret []byte, body []byte) []byte {
+	t.Helper()
+	if len(body) < 21 {
+		t.Fatalf("body too short: %d bytes", len(body))
+	}
+	salt := body[:16]
+	recordSize := binary.BigEndian.Uint32(body[16:20])
+	idLength := int(body[20])
+	asPublicBytes := body[21 : 21+idLength]
+	ciphertext := body[21+idLength:]
+	if recordSize != pushRecordSize {
+		t.Errorf("record size = %d, want %d", recordSize, pushRecordSize)
+	}
+
+	asPublic, err := ecdh.P256().NewPublicKey(asPublicBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecdhSecret, err := uaPrivate.ECDH(asPublic)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keyInfo := append(append([]byte("WebPush: info\x00"), uaPrivate.PublicKey().Bytes()...), asPublicBytes...)
+	ikm := hkdf(authSecret, ecdhSecret, keyInfo, 32)
+	cek := hkdf(salt, ikm, []byte("Content-Encoding: aes128gcm\x00"), 16)
+	nonce := hkdf(salt, ikm, []byte("Content-Encoding: nonce\x00"), 12)
+
+	block, err := aes.NewCipher(cek)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		t.Fatal(err)
+	}
+	padded, err := gcm.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(padded) == 0 || padded[len(padded)-1] != 2 {
+		t.Fatalf("last record delimiter missing: %x", padded)
+	}
+	return padded[:len(padded)-1]
+}
+
+// verifyVapidAuthorization checks the ES256 JWT of an Authorization header
+// against its k= key, which must be ours, and returns its claims.
+func verifyVapidAuthorization(t *testing.T, header string) map[string]any {
+	t.Helper()
+	token, key, ok := strings.Cut(strings.TrimPrefix(header, "vapid t="), ", k=")
+	if !ok || !strings.HasPrefix(header, "vapid t=") {
+		t.Fatalf("malformed Authorization header: %s", header)
+	}
+
+	publicKey, err := base64.RawURLEncoding.DecodeString(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected, err := vapidPublicKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(publicKey) != string(expected) {
+		t.Fatalf("k = %x, want %x", publicKey, expected)
+	}
+	if len(publicKey) != 65 || publicKey[0] != 4 {
+		t.Fatalf("k is not an uncompressed P-256 point: %x", publicKey)
+	}
+	verifier := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(publicKey[1:33]), Y: new(big.Int).SetBytes(publicKey[33:])}
+
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		t.Fatalf("malformed JWT: %s", token)
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil || len(signature) != 64 {
+		t.Fatalf("malformed JWT signature: %s", parts[2])
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if !ecdsa.Verify(verifier, digest[:], new(big.Int).SetBytes(signature[:32]), new(big.Int).SetBytes(signature[32:])) {
+		t.Fatal("JWT signature does not verify")
+	}
+
+	var jwtHeader map[string]string
+	decoded, _ := base64.RawURLEncoding.DecodeString(parts[0])
+	err = json.Unmarshal(decoded, &jwtHeader)
+	if err != nil || jwtHeader["alg"] != "ES256" {
+		t.Fatalf("JWT header = %s, want alg ES256", decoded)
+	}
+
+	var claims map[string]any
+	decoded, _ = base64.RawURLEncoding.DecodeString(parts[1])
+	err = json.Unmarshal(decoded, &claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return claims
+}
+
+func newTestVapidKey(t *testing.T) {
+	t.Helper()
+	previous := vapidKey
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	vapidKey = key
+	t.Cleanup(func() { vapidKey = previous })
+}
+
+func newTestSubscription(t *testing.T, endpoint string) (PushSubscription, *ecdh.PrivateKey, []byte) {
+	t.Helper()
+	uaPrivate, err := ecdh.P256().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	authSecret := make([]byte, 16)
+	_, err = rand.Read(authSecret)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var subscription PushSubscription
+	subscription.Endpoint = endpoint
+	subscription.Keys.P256dh = base64.RawURLEncoding.EncodeToString(uaPrivate.PublicKey().Bytes())
+	subscription.Keys.Auth = base64.RawURLEncoding.EncodeToString(authSecret)
+	return subscription, uaPrivate, authSecret
+}
+
+func TestSealPushPayload(t *testing.T) {
+	subscription, uaPrivate, authSecret := newTestSubscription(t, "https://push.example.com/send/1")
+	asPrivate, err := ecdh.P256().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	salt := make([]byte, 16)
+	_, err = rand.Read(salt)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	plaintext := []byte(`{"title":"5 bikes at Châtelet"}`)
+	body, err := sealPushPayload(uaPrivate.PublicKey(), authSecret, asPrivate, salt, plaintext)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(body[:16]) != string(salt) {
+		t.Errorf("salt = %x, want %x", body[:16], salt)
+	}
+	if got := openPushPayload(t, uaPrivate, authSecret, body); string(got) != string(plaintext) {
+		t.Errorf("decrypted %q, want %q", got, plaintext)
+	}
+
+	_, err = encryptPushPayload(subscription, make([]byte, pushRecordSize))
+	if err == nil {
+		t.Error("payload larger than a record was accepted")
+	}
+}
+
+func TestSendPush(t *testing.T) {
+	newTestVapidKey(t)
+
+	type received struct {
+		header http.Header
+		body   []byte
+	}
+	requests := make(chan received, 1)
+	status := http.StatusCreated
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		requests <- received{header: r.Header, body: body}
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+
+	// the stand-in push service listens on loopback, which pushClient
+	// refuses to reach
+	previous := pushClient
+	pushClient = server.Client()
+	defer func() { pushClient = previous }()
+
+	subscription, uaPrivate, authSecret := newTestSubscription(t, server.URL+"/send/abc")
+	payload := []byte(`{"watch_id":1}`)
+	err := sendPush(subscription, payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	request := <-requests
+	if got := request.header.Get("Content-Encoding"); got != "aes128gcm" {
+		t.Errorf("Content-Encoding = %q, want aes128gcm", got)
+	}
+	if got := request.header.Get("TTL"); got == "" {
+		t.Error("TTL header missing")
+	}
+	if got := openPushPayload(t, uaPrivate, authSecret, request.body); string(got) != string(payload) {
+		t.Errorf("decrypted %q, want %q", got, payload)
+	}
+
+	claims := verifyVapidAuthorization(t, request.header.Get("Authorization"))
+	if claims["aud"] != server.URL {
+		t.Errorf("aud = %v, want %s", claims["aud"], server.URL)
+	}
+	if claims["sub"] != vapidSubject {
+		t.Errorf("sub = %v, want %s", claims["sub"], vapidSubject)
+	}
+	exp, _ := claims["exp"].(float64)
+	if expires := time.Unix(int64(exp), 0); expires.Before(time.Now()) || expires.After(time.Now().Add(24*time.Hour)) {
+		t.Errorf("exp = %s, want within the next 24 hours", expires)
+	}
+
+	status = http.StatusGone
+	err = sendPush(subscription, payload)
+	<-requests
+	if err != errPushSubscriptionGone {
+		t.Errorf("sendPush on a gone subscription = %v, want errPushSubscriptionGone", err)
+	}
+}
+
+func TestPushSubscriptionValidate(t *testing.T) {
+	for _, endpoint := range []string{"http://push.example.com/send/1", "https://127.0.0.1/send/1", "https://169.254.169.254/latest", "https://[::1]/send/1", "https://10.0.0.1/send/1"} {
+		subscription, _, _ := newTestSubscription(t, endpoint)
+		if subscription.Validate() == nil {
+			t.Errorf("endpoint %s was accepted", endpoint)
+		}
+	}
+
+	subscription, _, _ := newTestSubscription(t, "https://93.184.215.14/send/1")
+	err := subscription.Validate()
+	if err != nil {
+		t.Errorf("public endpoint rejected: %v", err)
+	}
+
+	subscription.Keys.Auth = base64.RawURLEncoding.EncodeToString(make([]byte, 8))
+	if subscription.Validate() == nil {
+		t.Error("short auth secret was accepted")
+	}
+}
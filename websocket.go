@@ -0,0 +1,292 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// Minimal server side WebSocket implementation (RFC 6455): no extensions,
+// no subprotocols.
+
+const (
+	wsContinuation = 0x0
+	wsText         = 0x1
+	wsBinary       = 0x2
+	wsClose        = 0x8
+	wsPing         = 0x9
+	wsPong         = 0xa
+)
+
+// close status codes
+const (
+	wsCloseNormal        = 1000
+	wsCloseProtocolError = 1002
+	wsCloseInvalidData   = 1007
+	wsClosePolicy        = 1008
+	wsCloseTooBig        = 1009
+)
+
+const (
+	wsGUID           = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+	wsMaxMessageSize = 64 << 10
+	wsWriteTimeout   = 10 * time.Second
+	// pings are sent more often than this, so a silent peer is gone
+	wsReadTimeout = time.Minute
+)
+
+var errWebSocketClosed = errors.New("websocket closed")
+
+type wsCloseError struct {
+	Code   int
+	Reason string
+}
+
+func (e *wsCloseError) Error() string {
+	return "websocket: " + e.Reason
+}
+
+type wsConn struct {
+	conn    net.Conn
+	reader  *bufio.Reader
+	writeMu sync.Mutex
+	closed  bool
+}
+
+func headerContainsToken(h http.Header, name, token string) bool {
+	for _, value := range h.Values(name) {
+		for _, t := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// upgradeWebSocket performs the opening handshake and takes over the
+// connection. On failure an error response has already been written.
+func upgradeWebSocket(w http.ResponseWriter, r *http.Request) (*wsConn, error) {
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if !headerContainsToken(r.Header, "Connection", "upgrade") || !headerContainsToken(r.Header, "Upgrade", "websocket") || key == "" {
+		err := errors.New("not a websocket handshake")
+		handleHttpBadRequest(w, err)
+		return nil, err
+	}
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		err := errors.New("unsupported websocket version")
+		handleHttpBadRequest(w, err)
+		return nil, err
+	}
+
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		err := errors.New("connection cannot be hijacked")
+		handleHttpError(w, err)
+		return nil, err
+	}
+	conn, rw, err := hijacker.Hijack()
+	if err != nil {
+		handleHttpError(w, err)
+		return nil, err
+	}
+
+	accept := sha1.Sum([]byte(key + wsGUID))
+	_, err = rw.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: " +
+		base64.StdEncoding.EncodeToString(accept[:]) + "\r\n\r\n")
+	if err == nil {
+		err = rw.Flush()
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return &wsConn{conn: conn, reader: rw.Reader}, nil
+}
+
+func (c *wsConn) readFrame() (bool, int, []byte, error) {
+	err := c.conn.SetReadDeadline(time.Now().Add(wsReadTimeout))
+	if err != nil {
+		return false, 0, nil, err
+	}
+
+	var header [2]byte
+	_, err = io.ReadFull(c.reader, header[:])
+	if err != nil {
+		return false, 0, nil, err
+	}
+
+	fin := header[0]&0x80 != 0
+	opcode := int(header[0] & 0x0f)
+	if header[0]&0x70 != 0 {
+		return false, 0, nil, &wsCloseError{wsCloseProtocolError, "reserved bits set"}
+	}
+	if header[1]&0x80 == 0 {
+		return false, 0, nil, &wsCloseError{wsCloseProtocolError, "client frames must be masked"}
+	}
+
+	length := uint64(header[1] & 0x7f)
+	switch length {
+	case 126:
+		var ext [2]byte
+		_, err = io.ReadFull(c.reader, ext[:])
+		length = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		_, err = io.ReadFull(c.reader, ext[:])
+		length = binary.BigEndian.Uint64(ext[:])
+	}
+	if err != nil {
+		return false, 0, nil, err
+	}
+
+	if opcode >= wsClose && (length > 125 || !fin) {
+		return false, 0, nil, &wsCloseError{wsCloseProtocolError, "invalid control frame"}
+	}
+	if length > wsMaxMessageSize {
+		return false, 0, nil, &wsCloseError{wsCloseTooBig, "message too big"}
+	}
+
+	var mask [4]byte
+	_, err = io.ReadFull(c.reader, mask[:])
+	if err != nil {
+		return false, 0, nil, err
+	}
+
+	payload := make([]byte, length)
+	_, err = io.ReadFull(c.reader, payload)
+	if err != nil {
+		return false, 0, nil, err
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+
+	return fin, opcode, payload, nil
+}
+
+// ReadMessage returns the next text or binary message, answering pings and
+// the closing handshake along the way.
+func (c *wsConn) ReadMessage() (int, []byte, error) {
+	var opcode int
+	var message []byte
+	for {
+		fin, frameOpcode, payload, err := c.readFrame()
+		if err != nil {
+			var closeErr *wsCloseError
+			if errors.As(err, &closeErr) {
+				c.Close(closeErr.Code, closeErr.Reason)
+			}
+			return 0, nil, err
+		}
+
+		switch frameOpcode {
+		case wsPing:
+			err = c.writeFrame(wsPong, payload)
+			if err != nil {
+				return 0, nil, err
+			}
+			continue
+		case wsPong:
+			continue
+		case wsClose:
+			code := wsCloseNormal
+			if len(payload) >= 2 {
+				code = int(binary.BigEndian.Uint16(payload))
+			}
+			c.Close(code, "")
+			return 0, nil, errWebSocketClosed
+		case wsContinuation:
+			if message == nil {
+				c.Close(wsCloseProtocolError, "unexpected continuation frame")
+				return 0, nil, errWebSocketClosed
+			}
+		case wsText, wsBinary:
+			if message != nil {
+				c.Close(wsCloseProtocolError, "expected continuation frame")
+				return 0, nil, errWebSocketClosed
+			}
+			opcode = frameOpcode
+			message = []byte{}
+		default:
+			c.Close(wsCloseProtocolError, "unknown opcode")
+			return 0, nil, errWebSocketClosed
+		}
+
+		if len(message)+len(payload) > wsMaxMessageSize {
+			c.Close(wsCloseTooBig, "message too big")
+			return 0, nil, errWebSocketClosed
+		}
+		message = append(message, payload...)
+
+		if fin {
+			if opcode == wsText && !utf8.Valid(message) {
+				c.Close(wsCloseInvalidData, "invalid utf-8")
+				return 0, nil, errWebSocketClosed
+			}
+			return opcode, message, nil
+		}
+	}
+}
+
+func (c *wsConn) writeFrame(opcode int, payload []byte) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	if c.closed {
+		return errWebSocketClosed
+	}
+
+	frame := []byte{0x80 | byte(opcode)}
+	switch {
+	case len(payload) < 126:
+		frame = append(frame, byte(len(payload)))
+	case len(payload) <= 0xffff:
+		frame = append(frame, 126)
+		frame = binary.BigEndian.AppendUint16(frame, uint16(len(payload)))
+	default:
+		frame = append(frame, 127)
+		frame = binary.BigEndian.AppendUint64(frame, uint64(len(payload)))
+	}
+	frame = append(frame, payload...)
+
+	err := c.conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+	if err != nil {
+		return err
+	}
+	_, err = c.conn.Write(frame)
+	return err
+}
+
+func (c *wsConn) WriteText(message []byte) error {
+	return c.writeFrame(wsText, message)
+}
+
+func (c *wsConn) Ping() error {
+	return c.writeFrame(wsPing, nil)
+}
+
+// Close sends a close frame, if not done already, and closes the connection.
+func (c *wsConn) Close(code int, reason string) error {
+	payload := binary.BigEndian.AppendUint16(nil, uint16(code))
+	payload = append(payload, reason...)
+	err := c.writeFrame(wsClose, payload)
+
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	if c.closed {
+		return nil
+	}
+	c.closed = true
+	return errors.Join(err, c.conn.Close())
+}